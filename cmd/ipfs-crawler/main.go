@@ -2,9 +2,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"path"
+	"reflect"
+	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -15,27 +20,89 @@ import (
 
 	// Plugins
 	_ "ipfs-crawler/plugins/bsprobe"
+
+	// Observers
+	_ "ipfs-crawler/observers/eventlog"
 )
 
 // Config is the configuration for the ipfs-crawler executable.
+// It either configures a single network inline, or multiple networks in
+// Networks, which are then crawled concurrently.
 type Config struct {
+	NetworkConfig `yaml:",inline"`
+
+	// Networks to crawl concurrently. If set, the inline network
+	// configuration must be empty, i.e., none of its options may be set.
+	Networks []NetworkConfig `yaml:"networks"`
+}
+
+// NetworkConfig is the configuration for crawling a single network.
+type NetworkConfig struct {
+	// Name of the network, used in log messages. Only required for entries
+	// of Config.Networks.
+	Name string `yaml:"name"`
+
 	// Path to output directory.
 	OutputDirectoryPath string `yaml:"output_directory_path"`
 
 	// File where the nodes between crawls are cached (if caching is enabled).
 	CacheFilePath *string `yaml:"cache_file_path"`
 
+	// Whether to write results to disk while the crawl is running.
+	StreamOutput bool `yaml:"stream_output"`
+
 	// Settings for the crawler.
 	CrawlOptions crawlLib.CrawlManagerConfig `yaml:"crawler"`
 }
 
+func (c *Config) check() error {
+	if len(c.Networks) == 0 {
+		return nil
+	}
+	if !reflect.DeepEqual(c.NetworkConfig, NetworkConfig{}) {
+		return fmt.Errorf("networks and an inline network configuration are mutually exclusive")
+	}
+	names := make(map[string]struct{})
+	outputDirs := make(map[string]struct{})
+	for _, n := range c.Networks {
+		if len(n.Name) == 0 {
+			return fmt.Errorf("missing network name")
+		}
+		if _, ok := names[n.Name]; ok {
+			return fmt.Errorf("duplicate network name %q", n.Name)
+		}
+		names[n.Name] = struct{}{}
+		dir := path.Clean(n.OutputDirectoryPath)
+		if _, ok := outputDirs[dir]; ok {
+			return fmt.Errorf("network %s: output directory %s is used by another network", n.Name, dir)
+		}
+		outputDirs[dir] = struct{}{}
+	}
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "worker":
+			runWorker(os.Args[2:])
+			return
+		case "simulate":
+			runSimulate(os.Args[2:])
+			return
+		}
+	}
+
 	var debug bool
 	var configFilePath string
 	var help bool
+	var replayPath string
+	var resumePath string
 
 	flag.BoolVar(&debug, "debug", false, "enable debug logging")
 	flag.StringVar(&configFilePath, "config", "dist/config_ipfs.yaml", "path to the configuration file")
+	flag.StringVar(&resumePath, "resume", "", "path to a checkpoint file to resume a crawl from")
+	flag.StringVar(&replayPath, "replay", "", "path to a recording to replay instead of contacting peers")
 	flag.BoolVar(&help, "help", false, "print usage")
 	flag.Parse()
 
@@ -44,95 +111,278 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Set up logging
-	formatter := new(log.TextFormatter)
-	formatter.FullTimestamp = true
-	log.SetFormatter(formatter)
-	if debug {
-		log.SetLevel(log.DebugLevel)
-	} else {
-		log.SetLevel(log.InfoLevel)
-	}
+	setupLogging(debug)
 
 	config, err := parseConfig(configFilePath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if len(config.Networks) != 0 && len(resumePath) != 0 {
+		log.Fatal("--resume is not supported with multiple networks")
+	}
+	if len(replayPath) != 0 {
+		if len(config.Networks) != 0 {
+			log.Fatal("--replay is not supported with multiple networks")
+		}
+		config.CrawlOptions.ReplayFilePath = replayPath
+		config.CrawlOptions.RecordFilePath = ""
+	}
 
 	// Let's go!
 	log.Info("Thank you for running our IPFS Crawler!")
 
-	// First, check whether the weak RSA keys environment variable is set
-	// There's a clash between libp2p (2024) and ipfs (512) minimum key sizes -> set it to the one used in IPFS.
-	// Since libp2p ist initialized earlier than our main() function we have to set it via the command line.
-	_, weakKeysAllowed := os.LookupEnv("LIBP2P_ALLOW_WEAK_RSA_KEYS")
-	log.WithField("weak_RSA_keys", weakKeysAllowed).Debug("Checking whether weak RSA keys are allowed...")
-	if !weakKeysAllowed {
-		log.Fatal("Weak RSA keys are *disabled*. This is required to connect to most nodes. Set LIBP2P_ALLOW_WEAK_RSA_KEYS.")
+	checkWeakKeysAllowed()
+
+	// Stop the crawl early on SIGINT/SIGTERM, but keep what we have so far.
+	// A second signal terminates immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if len(config.Networks) == 0 {
+		err = runNetwork(ctx, &config.NetworkConfig, nil, resumePath, log.NewEntry(log.StandardLogger()))
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
+	// Load every preimage file only once, it is big.
+	preimages := make(map[string]*crawlLib.PreimageHandler)
+	for _, n := range config.Networks {
+		p := n.CrawlOptions.PreimageFilePath
+		if _, ok := preimages[p]; ok || n.CrawlOptions.NumWorkers == 0 || len(p) == 0 || len(n.CrawlOptions.ReplayFilePath) != 0 {
+			continue
+		}
+		preimages[p], err = crawlLib.LoadPreimages(p)
+		if err != nil {
+			log.Fatal(fmt.Errorf("unable to load preimages: %w", err))
+		}
+		log.WithField("path", p).Info("loaded preimages")
+	}
+
+	var wg sync.WaitGroup
+	failed := false
+	var failedM sync.Mutex
+	for i := range config.Networks {
+		n := &config.Networks[i]
+		logger := log.WithField("network", n.Name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := runNetwork(ctx, n, preimages[n.CrawlOptions.PreimageFilePath], "", logger)
+			if err != nil {
+				logger.WithError(err).Error("crawl failed")
+				failedM.Lock()
+				failed = true
+				failedM.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// runNetwork crawls a single network and writes the results.
+// If preimages is nil, they are loaded from the configured file.
+func runNetwork(ctx context.Context, config *NetworkConfig, preimages *crawlLib.PreimageHandler, resumePath string, logger *log.Entry) error {
 	// Create the directory for output data, if it does not exist
-	err = os.MkdirAll(config.OutputDirectoryPath, 0o777)
+	err := os.MkdirAll(config.OutputDirectoryPath, 0o777)
 	if err != nil {
-		log.Fatal(fmt.Errorf("unable to create output directory: %w", err))
+		return fmt.Errorf("unable to create output directory: %w", err)
 	}
-	log.WithField("path", config.OutputDirectoryPath).Info("writing results to")
+	logger.WithField("path", config.OutputDirectoryPath).Info("writing results to")
 
 	// Create crawl manager
-	cm, err := crawlLib.NewCrawlManager(config.CrawlOptions)
+	cm, err := crawlLib.NewCrawlManagerWithPreimages(config.CrawlOptions, preimages, logger)
 	if err != nil {
-		log.Fatal(fmt.Errorf("unable to set up crawler: %w", err))
+		return fmt.Errorf("unable to set up crawler: %w", err)
 	}
-	log.Info("created crawl manager")
+	logger.Info("created crawl manager")
 
-	// Add cached nodes if we have them
-	if config.CacheFilePath != nil {
+	// Resume a previous crawl or add cached nodes if we have them
+	if len(resumePath) != 0 {
+		err = cm.RestoreCheckpoint(resumePath)
+		if err != nil {
+			return fmt.Errorf("unable to resume crawl: %w", err)
+		}
+	} else if len(config.CrawlOptions.ReplayFilePath) != 0 {
+		// The recording knows which peers the crawl started at.
+		logger.Info("replaying recording, not loading cached peers")
+	} else if config.CacheFilePath != nil {
 		cachedNodes, err := crawlLib.RestoreNodeCache(*config.CacheFilePath)
 		if err != nil {
 			// First time may fail
-			log.WithError(err).Warn("unable to load cached peers, ignoring")
+			logger.WithError(err).Warn("unable to load cached peers, ignoring")
 		} else {
-			log.WithField("num", len(cachedNodes)).Info("loaded cached peers, adding to queue")
+			logger.WithField("num", len(cachedNodes)).Info("loaded cached peers, adding to queue")
 			cm.AddPeersToCrawl(cachedNodes)
 		}
 	} else {
-		log.Info("node caching disabled")
+		logger.Info("node caching disabled")
+	}
+
+	if config.CrawlOptions.Continuous != nil {
+		if len(resumePath) != 0 || config.StreamOutput {
+			return fmt.Errorf("--resume and stream_output are not supported in continuous mode")
+		}
+		return crawlContinuously(ctx, cm, config, logger)
 	}
 
 	// Start the crawl
 	before := time.Now()
-	beforeString := before.UTC().Format("2006-01-02_15-04-05_UTC")
-	report := cm.CrawlNetwork()
+	if len(resumePath) != 0 {
+		// Continue writing to the output of the original crawl.
+		before = cm.StartTime()
+	}
+	metadataPath, peergraphPath := outputPaths(config, before)
+
+	var stream *crawlLib.StreamingWriter
+	if config.StreamOutput {
+		stream, err = crawlLib.NewStreamingWriter(metadataPath, peergraphPath)
+		if err != nil {
+			return fmt.Errorf("unable to set up output streaming: %w", err)
+		}
+		cm.StreamResultsTo(stream)
+		logger.Info("streaming results to output directory")
+	}
+
+	report := cm.CrawlNetworkContext(ctx)
 	after := time.Now()
+	if report.Partial() {
+		logger.Warn("crawl was interrupted, results are partial")
+	}
 
 	// Stop libp2p nodes etc.
-	log.Debug("stopping crawl manager")
+	logger.Debug("stopping crawl manager")
 	err = cm.Stop()
 	if err != nil {
-		log.WithError(err).Warn("unable to gracefully shut down")
+		logger.WithError(err).Warn("unable to gracefully shut down")
 	}
-	log.Info("stopped crawl manager")
+	logger.Info("stopped crawl manager")
 
 	// Write output
-	log.Debug("writing node metadata")
-	err = report.WriteMetadata(before, after, path.Join(config.OutputDirectoryPath, fmt.Sprintf("visitedPeers_%s.json", beforeString)))
+	if stream != nil {
+		logger.Debug("finalizing streamed results")
+		err = stream.Finalize(before, after)
+		if err != nil {
+			return err
+		}
+		logger.Info("wrote results")
+		return saveNodeCache(config, report, logger)
+	}
+	return writeResults(config, report, before, after, logger)
+}
+
+// outputPaths returns the paths of the metadata and peer graph files of a
+// crawl started at the given time.
+func outputPaths(config *NetworkConfig, before time.Time) (string, string) {
+	beforeString := before.UTC().Format("2006-01-02_15-04-05_UTC")
+	metadataPath := path.Join(config.OutputDirectoryPath, fmt.Sprintf("visitedPeers_%s.json", beforeString))
+	peergraphPath := path.Join(config.OutputDirectoryPath, fmt.Sprintf("peerGraph_%s.csv", beforeString))
+	return metadataPath, peergraphPath
+}
+
+// writeResults writes the output of a crawl and updates the node cache.
+func writeResults(config *NetworkConfig, report crawlLib.CrawlOutput, before, after time.Time, logger *log.Entry) error {
+	metadataPath, peergraphPath := outputPaths(config, before)
+
+	logger.Debug("writing node metadata")
+	err := report.WriteMetadata(before, after, metadataPath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	log.Debug("writing peer graph")
-	err = report.WritePeergraph(path.Join(config.OutputDirectoryPath, fmt.Sprintf("peerGraph_%s.csv", beforeString)))
+	logger.Debug("writing peer graph")
+	err = report.WritePeergraph(peergraphPath)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	logger.Info("wrote results")
+
+	return saveNodeCache(config, report, logger)
+}
+
+// saveNodeCache writes the node cache, if enabled.
+func saveNodeCache(config *NetworkConfig, report crawlLib.CrawlOutput, logger *log.Entry) error {
+	if config.CacheFilePath != nil && len(config.CrawlOptions.ReplayFilePath) == 0 {
+		err := report.SaveNodeCache(*config.CacheFilePath)
+		if err != nil {
+			return fmt.Errorf("unable to save online nodes to cache: %w", err)
+		}
+		logger.WithField("path", config.CacheFilePath).Info("saved online nodes to cache")
+	}
+	return nil
+}
+
+// crawlContinuously crawls the network repeatedly until the context is
+// cancelled, writing the output of every round and periodic snapshots of the
+// network view.
+func crawlContinuously(ctx context.Context, cm *crawlLib.CrawlManager, config *NetworkConfig, logger *log.Entry) error {
+	writeSnapshot := func(snapshot crawlLib.NetworkSnapshot) {
+		tsString := snapshot.Timestamp.UTC().Format("2006-01-02_15-04-05_UTC")
+		snapshotPath := path.Join(config.OutputDirectoryPath, fmt.Sprintf("networkSnapshot_%s.json", tsString))
+		err := snapshot.WriteSnapshot(snapshotPath)
+		if err != nil {
+			logger.WithError(err).Error("unable to write snapshot")
+			return
+		}
+		logger.WithFields(log.Fields{
+			"path":   snapshotPath,
+			"peers":  len(snapshot.Peers),
+			"online": snapshot.NumOnline(),
+		}).Info("wrote snapshot")
 	}
-	log.Info("wrote results")
 
-	// Write node cache
-	if config.CacheFilePath != nil {
-		err = report.SaveNodeCache(*config.CacheFilePath)
+	snapshot, err := cm.CrawlContinuously(ctx, func(report crawlLib.CrawlOutput) {
+		if report.Partial() {
+			logger.Warn("round was interrupted, results are partial")
+		}
+		err := writeResults(config, report, cm.StartTime(), time.Now(), logger)
 		if err != nil {
-			log.Fatal(fmt.Errorf("unable to save online nodes to cache: %w", err))
+			logger.WithError(err).Error("unable to write results of round")
 		}
-		log.WithField("path", config.CacheFilePath).Info("saved online nodes to cache")
+	}, writeSnapshot)
+	writeSnapshot(snapshot)
+
+	logger.Debug("stopping crawl manager")
+	stopErr := cm.Stop()
+	if stopErr != nil {
+		logger.WithError(stopErr).Warn("unable to gracefully shut down")
+	}
+	logger.Info("stopped crawl manager")
+
+	if err != nil {
+		return fmt.Errorf("continuous crawl failed: %w", err)
+	}
+	return nil
+}
+
+// setupLogging configures the log format and level.
+func setupLogging(debug bool) {
+	formatter := new(log.TextFormatter)
+	formatter.FullTimestamp = true
+	log.SetFormatter(formatter)
+	if debug {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.InfoLevel)
+	}
+}
+
+// checkWeakKeysAllowed exits if the weak RSA keys environment variable is not
+// set.
+func checkWeakKeysAllowed() {
+	// There's a clash between libp2p (2024) and ipfs (512) minimum key sizes -> set it to the one used in IPFS.
+	// Since libp2p ist initialized earlier than our main() function we have to set it via the command line.
+	_, weakKeysAllowed := os.LookupEnv("LIBP2P_ALLOW_WEAK_RSA_KEYS")
+	log.WithField("weak_RSA_keys", weakKeysAllowed).Debug("Checking whether weak RSA keys are allowed...")
+	if !weakKeysAllowed {
+		log.Fatal("Weak RSA keys are *disabled*. This is required to connect to most nodes. Set LIBP2P_ALLOW_WEAK_RSA_KEYS.")
 	}
 }
 
@@ -147,6 +397,10 @@ func parseConfig(configFilePath string) (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("unable to unmarshal: %w", err)
 	}
+	err = config.check()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
 
 	return &config, nil
 }
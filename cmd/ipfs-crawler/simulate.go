@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+
+	crawlLib "ipfs-crawler/crawling"
+	"ipfs-crawler/simulation"
+)
+
+// runSimulate crawls a simulated network and compares the result with the
+// ground truth.
+// The crawler is configured through the crawler section of the configuration
+// file, except for the bootstrap peers, which are taken from the simulated
+// network. Preimages, worker_config apart from the connection settings,
+// plugins and continuous are not used.
+func runSimulate(args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	var debug bool
+	var configFilePath string
+	var help bool
+	var network string
+	var outputDirectoryPath string
+	var numBootstrapPeers int
+	var simConfig simulation.Config
+
+	flags.BoolVar(&debug, "debug", false, "enable debug logging")
+	flags.StringVar(&configFilePath, "config", "dist/config_ipfs.yaml", "path to the configuration file")
+	flags.StringVar(&network, "network", "", "name of the network to take the crawler configuration from, if the configuration file has multiple")
+	flags.StringVar(&outputDirectoryPath, "output", "", "directory to write the output of the crawl to, if any")
+	flags.IntVar(&numBootstrapPeers, "bootstrap-peers", 5, "number of bootstrap peers")
+	flags.IntVar(&simConfig.NumPeers, "peers", 1000, "number of peers in the network")
+	flags.IntVar(&simConfig.BucketSize, "bucket-size", 20, "maximum number of peers per bucket")
+	flags.Float64Var(&simConfig.MissingEntries, "missing-entries", 0, "probability that a peer does not know another peer it has room for")
+	flags.Float64Var(&simConfig.GhostPeers, "ghost-peers", 0, "number of peers that left the network but remain in routing tables, relative to --peers")
+	flags.Float64Var(&simConfig.Unreachable, "unreachable", 0, "fraction of peers that refuse connections")
+	flags.Float64Var(&simConfig.NonServers, "non-servers", 0, "fraction of reachable peers that do not serve the DHT")
+	flags.Float64Var(&simConfig.FindNodeFailures, "find-node-failures", 0, "probability that a FIND_NODE request fails")
+	flags.DurationVar(&simConfig.Latency, "latency", 0, "mean latency of requests")
+	flags.DurationVar(&simConfig.LatencyJitter, "latency-jitter", 0, "maximum deviation from the mean latency")
+	flags.DurationVar(&simConfig.MeanOnline, "mean-online", 0, "mean duration peers are online, if they churn")
+	flags.DurationVar(&simConfig.MeanOffline, "mean-offline", 0, "mean duration peers are offline, zero disables churn")
+	flags.Int64Var(&simConfig.Seed, "seed", 1, "seed for the simulated network")
+	flags.BoolVar(&help, "help", false, "print usage")
+	_ = flags.Parse(args)
+
+	if help {
+		flags.PrintDefaults()
+		os.Exit(0)
+	}
+
+	setupLogging(debug)
+
+	config, err := parseConfig(configFilePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	options, err := crawlOptions(config, network)
+	if err != nil {
+		log.Fatal(err)
+	}
+	options.RemoteWorkers = nil
+	options.ReplayFilePath = ""
+	options.Continuous = nil
+	options.CheckpointFilePath = ""
+
+	before := time.Now()
+	sim, err := simulation.New(simConfig)
+	if err != nil {
+		log.Fatal(fmt.Errorf("unable to create simulated network: %w", err))
+	}
+	options.BootstrapPeers = sim.BootstrapPeers(numBootstrapPeers)
+	log.WithFields(log.Fields{
+		"peers":    simConfig.NumPeers,
+		"duration": time.Since(before),
+	}).Info("created simulated network")
+
+	cm, err := crawlLib.NewCrawlManagerWithNetwork(options, sim)
+	if err != nil {
+		log.Fatal(fmt.Errorf("unable to set up crawler: %w", err))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	before = time.Now()
+	report := cm.CrawlNetworkContext(ctx)
+	after := time.Now()
+	err = cm.Stop()
+	if err != nil {
+		log.WithError(err).Warn("unable to stop crawl manager")
+	}
+
+	e := sim.Evaluate(&report)
+	log.WithFields(log.Fields{
+		"duration":          after.Sub(before),
+		"peers":             e.NumPeers,
+		"discoverable":      e.NumDiscoverable,
+		"discovered":        e.NumDiscovered,
+		"ghosts discovered": e.NumGhostsDiscovered,
+		"reachable":         e.NumReachable,
+		"connectable":       e.NumConnectable,
+		"servers":           e.NumServers,
+		"crawlable":         e.NumCrawlable,
+		"edges":             e.NumEdges,
+		"edges found":       e.NumEdgesFound,
+		"false positives":   e.NumFalsePositives,
+		"misclassified":     e.NumMisclassified,
+	}).Info("compared crawl with ground truth")
+
+	if len(outputDirectoryPath) != 0 {
+		err = os.MkdirAll(outputDirectoryPath, 0o777)
+		if err != nil {
+			log.Fatal(fmt.Errorf("unable to create output directory: %w", err))
+		}
+		nc := &NetworkConfig{OutputDirectoryPath: outputDirectoryPath, CrawlOptions: options}
+		err = writeResults(nc, report, before, after, log.NewEntry(log.StandardLogger()))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
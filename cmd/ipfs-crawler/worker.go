@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+
+	crawlLib "ipfs-crawler/crawling"
+)
+
+// runWorker runs a worker agent, which probes peers on behalf of crawlers on
+// other machines that list it in their remote_workers.
+// The worker is configured through the crawler section of the same
+// configuration file, using preimage_file_path, worker_config, plugins and
+// crawler_config. If the file configures multiple networks, the network must
+// be selected with --network.
+func runWorker(args []string) {
+	flags := flag.NewFlagSet("worker", flag.ExitOnError)
+	var debug bool
+	var configFilePath string
+	var help bool
+	var listenAddr string
+	var name string
+	var network string
+
+	flags.BoolVar(&debug, "debug", false, "enable debug logging")
+	flags.StringVar(&configFilePath, "config", "dist/config_ipfs.yaml", "path to the configuration file")
+	flags.StringVar(&listenAddr, "listen", ":7070", "address to listen on for requests from crawlers")
+	flags.StringVar(&name, "name", "", "name of the worker in the crawl output, defaults to the hostname")
+	flags.StringVar(&network, "network", "", "name of the network to probe peers of, if the configuration file has multiple")
+	flags.BoolVar(&help, "help", false, "print usage")
+	_ = flags.Parse(args)
+
+	if help {
+		flags.PrintDefaults()
+		os.Exit(0)
+	}
+
+	setupLogging(debug)
+
+	config, err := parseConfig(configFilePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	options, err := crawlOptions(config, network)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(options.PreimageFilePath) == 0 {
+		log.Fatal("missing preimage file path")
+	}
+
+	if len(name) == 0 {
+		name, err = os.Hostname()
+		if err != nil {
+			log.Fatal(fmt.Errorf("unable to determine hostname: %w", err))
+		}
+	}
+
+	checkWeakKeysAllowed()
+
+	preimageHandler, err := crawlLib.LoadPreimages(options.PreimageFilePath)
+	if err != nil {
+		log.Fatal(fmt.Errorf("unable to load preimages: %w", err))
+	}
+	log.WithField("path", options.PreimageFilePath).Info("loaded preimages")
+
+	worker, err := crawlLib.NewLibp2pWorker(options.WorkerConfig, options.Plugins, preimageHandler, options.CrawlerConfig)
+	if err != nil {
+		log.Fatal(fmt.Errorf("unable to create worker: %w", err))
+	}
+
+	workerServer := crawlLib.NewWorkerServer(name, worker)
+	server := &http.Server{
+		Addr:              listenAddr,
+		Handler:           workerServer,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	// Stop serving on SIGINT/SIGTERM, after finishing in-flight requests.
+	// A second signal terminates immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	shutDown := make(chan struct{})
+	go func() {
+		defer close(shutDown)
+		<-ctx.Done()
+		stop()
+		log.Info("shutting down worker")
+		err := server.Shutdown(context.Background())
+		if err != nil {
+			log.WithError(err).Warn("unable to gracefully shut down server")
+		}
+	}()
+
+	log.WithFields(log.Fields{
+		"name":    name,
+		"address": listenAddr,
+	}).Info("worker listening")
+	err = server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(fmt.Errorf("unable to serve: %w", err))
+	}
+	<-shutDown
+
+	err = workerServer.Close()
+	if err != nil {
+		log.WithError(err).Warn("unable to stop worker")
+	}
+	log.Info("stopped worker")
+}
+
+// crawlOptions returns the crawler configuration of the given network, or of
+// the inline network if the configuration has no networks.
+func crawlOptions(config *Config, network string) (crawlLib.CrawlManagerConfig, error) {
+	if len(config.Networks) == 0 {
+		return config.CrawlOptions, nil
+	}
+	if len(network) == 0 {
+		return crawlLib.CrawlManagerConfig{}, fmt.Errorf("the configuration has multiple networks, select one with --network")
+	}
+	for _, n := range config.Networks {
+		if n.Name == network {
+			return n.CrawlOptions, nil
+		}
+	}
+	return crawlLib.CrawlManagerConfig{}, fmt.Errorf("unknown network %q", network)
+}
@@ -0,0 +1,131 @@
+package crawling
+
+import (
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// dhtAddrReports holds, for every peer found in the routing table of another
+// peer, the addresses reported for it and by whom.
+type dhtAddrReports map[peer.ID]*peerAddrReports
+
+// peerAddrReports holds the addresses of a single peer reported by other peers
+// in FIND_NODE responses.
+type peerAddrReports struct {
+	// The peers which reported the peer, with or without addresses.
+	reporters map[peer.ID]struct{}
+
+	// The distinct addresses reported, in order of their first report.
+	addrs []reportedAddr
+}
+
+// reportedAddr is an address of a peer and the peers which reported it.
+type reportedAddr struct {
+	addr      ma.Multiaddr
+	reporters []peer.ID
+}
+
+// add records that source reported p with its addresses.
+func (r dhtAddrReports) add(p peer.AddrInfo, source peer.ID) {
+	reports, ok := r[p.ID]
+	if !ok {
+		reports = &peerAddrReports{reporters: make(map[peer.ID]struct{})}
+		r[p.ID] = reports
+	}
+	_, again := reports.reporters[source]
+	reports.reporters[source] = struct{}{}
+
+	for _, addr := range p.Addrs {
+		i := reports.index(addr)
+		if i < 0 {
+			reports.addrs = append(reports.addrs, reportedAddr{addr: addr, reporters: []peer.ID{source}})
+			continue
+		}
+		ra := &reports.addrs[i]
+		// Sources usually report a peer only once, so we only need to look
+		// for duplicates if they reported it before.
+		if again && containsPeer(ra.reporters, source) {
+			continue
+		}
+		ra.reporters = append(ra.reporters, source)
+	}
+}
+
+// index returns the index of the given address in r.addrs, or -1.
+func (r *peerAddrReports) index(addr ma.Multiaddr) int {
+	for i, ra := range r.addrs {
+		if ra.addr.Equal(addr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// listed returns whether the given peer was found in the routing table of at
+// least one other peer.
+func (r dhtAddrReports) listed(id peer.ID) bool {
+	_, ok := r[id]
+	return ok
+}
+
+// addrs returns the distinct addresses reported for the given peer.
+func (r dhtAddrReports) addrs(id peer.ID) []ma.Multiaddr {
+	reports, ok := r[id]
+	if !ok {
+		return nil
+	}
+	res := make([]ma.Multiaddr, 0, len(reports.addrs))
+	for _, ra := range reports.addrs {
+		res = append(res, ra.addr)
+	}
+	return res
+}
+
+func containsPeer(ids []peer.ID, id peer.ID) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+// addrOverlap compares the addresses a peer listens on according to identify
+// with those reported for it in routing tables.
+type addrOverlap struct {
+	// The number of addresses in both sets.
+	common int
+
+	// The number of addresses only reported in routing tables, which are
+	// likely stale.
+	onlyDHT int
+
+	// The number of addresses the peer listens on, but which were not
+	// reported in routing tables.
+	onlyListen int
+}
+
+// compareAddrs compares the addresses a peer listens on with those reported
+// for it in routing tables.
+func compareAddrs(listen []ma.Multiaddr, dht []ma.Multiaddr) addrOverlap {
+	var res addrOverlap
+	inDHT := make(map[string]struct{}, len(dht))
+	for _, addr := range dht {
+		inDHT[string(addr.Bytes())] = struct{}{}
+	}
+	inListen := make(map[string]struct{}, len(listen))
+	for _, addr := range listen {
+		key := string(addr.Bytes())
+		if _, ok := inListen[key]; ok {
+			continue
+		}
+		inListen[key] = struct{}{}
+		if _, ok := inDHT[key]; ok {
+			res.common++
+		} else {
+			res.onlyListen++
+		}
+	}
+	res.onlyDHT = len(inDHT) - res.common
+	return res
+}
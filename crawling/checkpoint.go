@@ -0,0 +1,444 @@
+package crawling
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/DataDog/zstd"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkpointVersion is incremented whenever the checkpoint format changes in
+// an incompatible way.
+const checkpointVersion = 2
+
+// checkpointJSON is a helper struct to serialize the state of a CrawlManager
+// to JSON.
+type checkpointJSON struct {
+	Version      int         `json:"version"`
+	StartTs      time.Time   `json:"start_timestamp"`
+	CheckpointTs time.Time   `json:"checkpoint_timestamp"`
+	ResumedAt    []time.Time `json:"resumed_at"`
+
+	// The peers to crawl, in order.
+	// This includes peers that were in flight or waiting for a retry when the
+	// checkpoint was taken.
+	Queue    []peer.ID                       `json:"queue"`
+	AddrInfo map[peer.ID][]ma.Multiaddr      `json:"addr_info"`
+	Crawled  map[peer.ID]nodeCrawlStatusJSON `json:"crawled"`
+
+	// The peers found in the routing table of at least one other peer, with
+	// the addresses reported for them.
+	// Missing in checkpoints written by older versions.
+	DHTAddrs map[peer.ID]peerAddrReportsJSON `json:"dht_addrs"`
+}
+
+// peerAddrReportsJSON is a helper struct to serialize a peerAddrReports to
+// JSON.
+type peerAddrReportsJSON struct {
+	ReportedBy []peer.ID          `json:"reported_by"`
+	Addrs      []reportedAddrJSON `json:"addrs"`
+}
+
+// nodeCrawlStatusJSON is a helper struct to serialize a nodeCrawlStatus to
+// JSON.
+// Only the attempts are stored, the status is merged from them again when
+// restoring.
+// Errors are stored as strings along with their ErrorCode, and restored as
+// opaque errors with that code.
+type nodeCrawlStatusJSON struct {
+	Attempts []crawlAttemptCheckpointJSON `json:"attempts"`
+}
+
+// crawlAttemptCheckpointJSON is a helper struct to serialize a crawlAttempt to
+// JSON.
+type crawlAttemptCheckpointJSON struct {
+	StartTs   time.Time            `json:"start_ts"`
+	EndTs     time.Time            `json:"end_ts"`
+	Addrs     []ma.Multiaddr       `json:"addrs"`
+	Worker    string               `json:"worker"`
+	Dials     []addrDialJSON       `json:"dials,omitempty"`
+	Err       *string              `json:"err"`
+	ErrCode   *ErrorCode           `json:"err_code"`
+	Result    *nodeInformationJSON `json:"result"`
+	Retryable bool                 `json:"retryable"`
+
+	NumNeighbors int `json:"num_neighbors"`
+}
+
+// nodeInformationJSON is a helper struct to serialize a nodeInformation to
+// JSON.
+type nodeInformationJSON struct {
+	ConnectedAddr ma.Multiaddr                          `json:"connected_addr,omitempty"`
+	Info          PeerMetadata                          `json:"info"`
+	PluginResults map[string]pluginResultCheckpointJSON `json:"plugin_results"`
+
+	IdentifyError     *string    `json:"identify_error"`
+	IdentifyErrorCode *ErrorCode `json:"identify_error_code"`
+
+	Timings Timings `json:"timings"`
+
+	PingSamples   []time.Duration `json:"ping_samples"`
+	PingError     *string         `json:"ping_error"`
+	PingErrorCode *ErrorCode      `json:"ping_error_code"`
+
+	CrawlDataError     *string    `json:"crawl_data_error"`
+	CrawlDataErrorCode *ErrorCode `json:"crawl_data_error_code"`
+	CrawlDataBeginTs   time.Time  `json:"crawl_data_begin_ts"`
+	CrawlDataEndTs     time.Time  `json:"crawl_data_end_ts"`
+	CrawlNeighbors     []peer.ID  `json:"crawl_neighbors"`
+
+	CrawlBuckets []bucketResultJSON `json:"crawl_buckets"`
+
+	CrawlDataPartialError     *string    `json:"crawl_data_partial_error"`
+	CrawlDataPartialErrorCode *ErrorCode `json:"crawl_data_partial_error_code"`
+}
+
+// pluginResultCheckpointJSON is a helper struct to serialize a pluginResult to
+// JSON.
+// The result is kept as raw JSON, so that it is written to the crawl output
+// exactly as it would have been without the checkpoint.
+type pluginResultCheckpointJSON struct {
+	BeginTimestamp time.Time       `json:"begin_timestamp"`
+	EndTimestamp   time.Time       `json:"end_timestamp"`
+	Error          *string         `json:"error"`
+	ErrorCode      *ErrorCode      `json:"error_code"`
+	Result         json.RawMessage `json:"result"`
+}
+
+// errorToString converts a possibly nil error to a possibly nil string.
+func errorToString(err error) *string {
+	if err == nil {
+		return nil
+	}
+	tmp := err.Error()
+	return &tmp
+}
+
+// errorFromString restores an error converted with errorToString and
+// errorCodeToString.
+// Errors we define ourselves are restored to their original values, so that
+// errors.Is keeps working.
+func errorFromString(s *string, code *ErrorCode) error {
+	if s == nil {
+		return nil
+	}
+	for _, known := range []error{ErrCrawlDeadlineExceeded, ErrCrawlInterrupted} {
+		if *s == known.Error() {
+			return known
+		}
+	}
+	msg, noNeighbors := strings.CutPrefix(*s, errNoNeighbors.Error()+": ")
+	var err error
+	if code == nil {
+		// Written before error codes were introduced.
+		err = errors.New(msg)
+	} else {
+		err = &classifiedError{code: *code, err: errors.New(msg)}
+	}
+	if noNeighbors {
+		return fmt.Errorf("%w: %w", errNoNeighbors, err)
+	}
+	return err
+}
+
+func (r nodeCrawlStatus) toJSON() (nodeCrawlStatusJSON, error) {
+	var res nodeCrawlStatusJSON
+	for _, a := range r.attempts {
+		result, err := a.result.toJSON()
+		if err != nil {
+			return res, err
+		}
+		res.Attempts = append(res.Attempts, crawlAttemptCheckpointJSON{
+			StartTs:   a.startTs,
+			EndTs:     a.endTs,
+			Addrs:     a.addrs,
+			Worker:    a.worker,
+			Dials:     addrDialsToJSON(a.dials),
+			Err:       errorToString(a.err),
+			ErrCode:   errorCodeToString(a.err),
+			Result:    result,
+			Retryable: a.retryable,
+
+			NumNeighbors: a.numNeighbors,
+		})
+	}
+	return res, nil
+}
+
+func (r *nodeInformation) toJSON() (*nodeInformationJSON, error) {
+	if r == nil {
+		return nil, nil
+	}
+
+	res := &nodeInformationJSON{
+		ConnectedAddr:      r.connectedAddr,
+		Info:               r.info,
+		IdentifyError:      errorToString(r.identifyError),
+		IdentifyErrorCode:  errorCodeToString(r.identifyError),
+		Timings:            r.timings,
+		PingSamples:        r.pingSamples,
+		PingError:          errorToString(r.pingError),
+		PingErrorCode:      errorCodeToString(r.pingError),
+		CrawlDataError:     errorToString(r.crawlDataError),
+		CrawlDataErrorCode: errorCodeToString(r.crawlDataError),
+		CrawlDataBeginTs:   r.crawlDataBeginTs,
+		CrawlDataEndTs:     r.crawlDataEndTs,
+		CrawlNeighbors:     r.crawlNeighbors,
+		CrawlBuckets:       bucketResultsToJSON(r.crawlBuckets),
+
+		CrawlDataPartialError:     errorToString(r.crawlDataPartialError),
+		CrawlDataPartialErrorCode: errorCodeToString(r.crawlDataPartialError),
+	}
+	if len(r.pluginResults) != 0 {
+		res.PluginResults = make(map[string]pluginResultCheckpointJSON)
+		for pn, pd := range r.pluginResults {
+			result, err := json.Marshal(pd.result)
+			if err != nil {
+				return nil, fmt.Errorf("unable to encode result of plugin %s: %w", pn, err)
+			}
+			res.PluginResults[pn] = pluginResultCheckpointJSON{
+				BeginTimestamp: pd.beginTimestamp,
+				EndTimestamp:   pd.endTimestamp,
+				Error:          errorToString(pd.err),
+				ErrorCode:      errorCodeToString(pd.err),
+				Result:         result,
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func (r nodeCrawlStatusJSON) toNodeCrawlStatus() nodeCrawlStatus {
+	attempts := make([]crawlAttempt, 0, len(r.Attempts))
+	for _, a := range r.Attempts {
+		attempt := crawlAttempt{
+			startTs:      a.StartTs,
+			endTs:        a.EndTs,
+			addrs:        a.Addrs,
+			worker:       a.Worker,
+			dials:        addrDialsFromJSON(a.Dials),
+			err:          errorFromString(a.Err, a.ErrCode),
+			result:       a.Result.toNodeInformation(),
+			retryable:    a.Retryable,
+			numNeighbors: a.NumNeighbors,
+		}
+		if attempt.numNeighbors == 0 && attempt.result != nil {
+			// Written before the number of neighbors was recorded.
+			attempt.numNeighbors = len(attempt.result.crawlNeighbors)
+		}
+		attempts = append(attempts, attempt)
+	}
+	return mergeAttempts(attempts)
+}
+
+func (r *nodeInformationJSON) toNodeInformation() *nodeInformation {
+	if r == nil {
+		return nil
+	}
+
+	res := &nodeInformation{
+		connectedAddr:    r.ConnectedAddr,
+		info:             r.Info,
+		identifyError:    errorFromString(r.IdentifyError, r.IdentifyErrorCode),
+		timings:          r.Timings,
+		pingSamples:      r.PingSamples,
+		pingError:        errorFromString(r.PingError, r.PingErrorCode),
+		crawlDataError:   errorFromString(r.CrawlDataError, r.CrawlDataErrorCode),
+		crawlDataBeginTs: r.CrawlDataBeginTs,
+		crawlDataEndTs:   r.CrawlDataEndTs,
+		crawlNeighbors:   r.CrawlNeighbors,
+		crawlBuckets:     bucketResultsFromJSON(r.CrawlBuckets),
+
+		crawlDataPartialError: errorFromString(r.CrawlDataPartialError, r.CrawlDataPartialErrorCode),
+	}
+	if len(r.PluginResults) != 0 {
+		res.pluginResults = make(map[string]pluginResult)
+		for pn, pd := range r.PluginResults {
+			res.pluginResults[pn] = pluginResult{
+				beginTimestamp: pd.BeginTimestamp,
+				endTimestamp:   pd.EndTimestamp,
+				err:            errorFromString(pd.Error, pd.ErrorCode),
+				result:         pd.Result,
+			}
+		}
+	}
+
+	return res
+}
+
+// writeCheckpoint writes the current state of the crawl to the configured
+// checkpoint file.
+// The file is replaced atomically and compressed if its name ends in ".zst".
+func (cm *CrawlManager) writeCheckpoint() error {
+	path := cm.config.CheckpointFilePath
+
+	cp := checkpointJSON{
+		Version:      checkpointVersion,
+		StartTs:      cm.startTs,
+		CheckpointTs: time.Now(),
+		ResumedAt:    cm.resumedAt,
+		AddrInfo:     cm.toCrawl.addrInfo,
+		Crawled:      make(map[peer.ID]nodeCrawlStatusJSON, len(cm.crawled)),
+	}
+	cp.Queue = cm.toCrawl.policy.queued()
+	for id := range cm.crawlsInProgress {
+		if _, ok := cm.toCrawl.inQueue[id]; !ok {
+			cp.Queue = append(cp.Queue, id)
+		}
+	}
+	for id := range cm.deferredUntil {
+		if _, ok := cm.toCrawl.inQueue[id]; !ok {
+			cp.Queue = append(cp.Queue, id)
+		}
+	}
+	cp.DHTAddrs = make(map[peer.ID]peerAddrReportsJSON, len(cm.toCrawl.dhtAddrs))
+	for id, reports := range cm.toCrawl.dhtAddrs {
+		r := peerAddrReportsJSON{
+			ReportedBy: make([]peer.ID, 0, len(reports.reporters)),
+			Addrs:      reports.reportedAddrsToJSON(),
+		}
+		for source := range reports.reporters {
+			r.ReportedBy = append(r.ReportedBy, source)
+		}
+		cp.DHTAddrs[id] = r
+	}
+	for id, status := range cm.crawled {
+		var err error
+		cp.Crawled[id], err = status.toJSON()
+		if err != nil {
+			return fmt.Errorf("unable to encode status of %s: %w", id, err)
+		}
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("unable to create checkpoint file: %w", err)
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	var w io.WriteCloser = f
+	if strings.HasSuffix(path, ".zst") {
+		w = zstd.NewWriter(f)
+	}
+	err = json.NewEncoder(w).Encode(cp)
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("unable to write checkpoint: %w", err)
+	}
+	if w != f {
+		err = w.Close()
+		if err != nil {
+			_ = f.Close()
+			return fmt.Errorf("unable to write checkpoint: %w", err)
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("unable to write checkpoint: %w", err)
+	}
+
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return fmt.Errorf("unable to replace checkpoint: %w", err)
+	}
+
+	cm.logger.WithFields(log.Fields{
+		"path":    path,
+		"queue":   len(cp.Queue),
+		"crawled": len(cp.Crawled),
+	}).Debug("wrote checkpoint")
+
+	return nil
+}
+
+// RestoreCheckpoint restores the state of a previous crawl from a checkpoint
+// file, so that CrawlNetwork continues that crawl.
+// This must be called before CrawlNetwork.
+// It replaces the crawl queue, including bootstrap peers and peers added with
+// AddPeersToCrawl.
+// Peers that were being probed or waiting for a retry when the checkpoint was
+// taken are probed again right away.
+func (cm *CrawlManager) RestoreCheckpoint(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open checkpoint: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".zst") {
+		compressed := zstd.NewReader(f)
+		defer func() { _ = compressed.Close() }()
+		r = compressed
+	}
+
+	var cp checkpointJSON
+	err = json.NewDecoder(r).Decode(&cp)
+	if err != nil {
+		return fmt.Errorf("unable to decode checkpoint: %w", err)
+	}
+	if cp.Version != checkpointVersion {
+		return fmt.Errorf("unsupported checkpoint version %d", cp.Version)
+	}
+
+	cm.startTs = cp.StartTs
+	cm.resumedAt = append(cp.ResumedAt, time.Now())
+	cm.crawled = make(map[peer.ID]nodeCrawlStatus, len(cp.Crawled))
+	policy, err := newSchedulingPolicy(cm.config.SchedulingPolicy)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	cm.toCrawl = newToCrawlQueue(policy)
+	if cp.AddrInfo != nil {
+		cm.toCrawl.addrInfo = cp.AddrInfo
+	}
+	for id, r := range cp.DHTAddrs {
+		reports := &peerAddrReports{reporters: make(map[peer.ID]struct{}, len(r.ReportedBy))}
+		for _, source := range r.ReportedBy {
+			reports.reporters[source] = struct{}{}
+		}
+		for _, ra := range r.Addrs {
+			reports.addrs = append(reports.addrs, reportedAddr{addr: ra.Addr, reporters: ra.ReportedBy})
+		}
+		cm.toCrawl.dhtAddrs[id] = reports
+	}
+
+	for id, status := range cp.Crawled {
+		if len(status.Attempts) == 0 {
+			return fmt.Errorf("invalid checkpoint: no attempts for %s", id)
+		}
+		ncs := status.toNodeCrawlStatus()
+		if last := ncs.attempts[len(ncs.attempts)-1]; errors.Is(last.err, ErrCrawlInterrupted) {
+			// Abandoned when the crawl was interrupted, try again.
+			cp.Queue = append(cp.Queue, id)
+			if len(ncs.attempts) == 1 {
+				continue
+			}
+			ncs = mergeAttempts(ncs.attempts[:len(ncs.attempts)-1])
+		}
+		cm.crawled[id] = ncs
+	}
+	for _, id := range cp.Queue {
+		cm.toCrawl.enqueue(id)
+	}
+
+	cm.logger.WithFields(log.Fields{
+		"path":       path,
+		"started":    cp.StartTs,
+		"checkpoint": cp.CheckpointTs,
+		"queue":      cm.toCrawl.len(),
+		"crawled":    len(cm.crawled),
+	}).Info("restored checkpoint")
+
+	return nil
+}
@@ -0,0 +1,387 @@
+package crawling
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	log "github.com/sirupsen/logrus"
+)
+
+// ContinuousConfig contains configuration for continuous crawls, see
+// CrawlContinuously.
+type ContinuousConfig struct {
+	// How often to start a new round, i.e., re-crawl every known peer.
+	// If a round takes longer than this, the next round starts immediately.
+	RoundInterval time.Duration `yaml:"round_interval"`
+
+	// How often to emit a snapshot of the network view.
+	// If zero, a snapshot is only emitted once the crawl ends.
+	SnapshotInterval time.Duration `yaml:"snapshot_interval"`
+
+	// Peers which have not been online for this duration are no longer
+	// re-crawled in new rounds. They are still crawled if rediscovered.
+	// If zero, all known peers are re-crawled.
+	OfflineEviction time.Duration `yaml:"offline_eviction"`
+}
+
+func (c *ContinuousConfig) check() error {
+	if c.RoundInterval <= 0 {
+		return fmt.Errorf("missing or invalid round_interval")
+	}
+	if c.SnapshotInterval < 0 {
+		return fmt.Errorf("invalid snapshot_interval")
+	}
+	if c.OfflineEviction < 0 {
+		return fmt.Errorf("invalid offline_eviction")
+	}
+	return nil
+}
+
+// PeerHistory is what we know about a peer over the course of a continuous
+// crawl.
+type PeerHistory struct {
+	// When we first learned about the peer.
+	FirstDiscovered time.Time
+
+	// When the peer was first and last online, i.e., connectable.
+	// These are zero if the peer was never online.
+	FirstSeen time.Time
+	LastSeen  time.Time
+
+	// When the peer was last probed, and whether it was online then.
+	LastProbed time.Time
+	Online     bool
+
+	// The agent version reported by the peer when it was last online.
+	AgentVersion string
+
+	// The periods during which the peer was online, oldest first.
+	// If the peer is online, the last session is ongoing.
+	Sessions []Session
+}
+
+// Session is a period during which a peer was online, i.e., all probes between
+// Start and End found the peer online.
+type Session struct {
+	Start time.Time
+	End   time.Time
+}
+
+// NetworkSnapshot is the view of the network at some point during a continuous
+// crawl.
+type NetworkSnapshot struct {
+	Timestamp time.Time
+
+	// The round of the crawl at the time of the snapshot, starting at 1.
+	Round int
+
+	Peers map[peer.ID]PeerHistory
+}
+
+// NumOnline returns the number of peers which were online when they were last
+// probed.
+func (s NetworkSnapshot) NumOnline() int {
+	n := 0
+	for _, h := range s.Peers {
+		if h.Online {
+			n++
+		}
+	}
+	return n
+}
+
+// networkView keeps the history of all peers during a continuous crawl.
+// It is updated through the Observer interface and safe for concurrent use.
+type networkView struct {
+	NopObserver
+
+	m     sync.Mutex
+	round int
+	peers map[peer.ID]*PeerHistory
+}
+
+func newNetworkView() *networkView {
+	return &networkView{peers: make(map[peer.ID]*PeerHistory)}
+}
+
+func (v *networkView) setRound(round int) {
+	v.m.Lock()
+	defer v.m.Unlock()
+	v.round = round
+}
+
+// get returns the history of the given peer, creating it if necessary.
+// The caller must hold the lock.
+func (v *networkView) get(id peer.ID, ts time.Time) *PeerHistory {
+	h, ok := v.peers[id]
+	if !ok {
+		h = &PeerHistory{FirstDiscovered: ts}
+		v.peers[id] = h
+	}
+	return h
+}
+
+func (v *networkView) OnPeerDiscovered(p peer.AddrInfo, _ peer.ID) {
+	v.m.Lock()
+	defer v.m.Unlock()
+	v.get(p.ID, time.Now())
+}
+
+// OnCrawlFinished records the outcome of the attempt that just finished.
+// This is the latest attempt, not the best one the result describes, since an
+// earlier successful attempt says nothing about whether the peer is online now.
+func (v *networkView) OnCrawlFinished(result NodeStatus) {
+	if len(result.Attempts) == 0 {
+		return
+	}
+	latest := result.Attempts[len(result.Attempts)-1]
+	if isAbandoned(latest.ConnectionError) {
+		// We don't know whether the peer is online.
+		return
+	}
+
+	v.m.Lock()
+	defer v.m.Unlock()
+
+	h := v.get(result.ID, latest.StartTimestamp)
+	ts := latest.EndTimestamp
+	h.LastProbed = ts
+	if latest.ConnectionError != nil {
+		h.Online = false
+		return
+	}
+
+	if h.FirstSeen.IsZero() {
+		h.FirstSeen = ts
+	}
+	h.LastSeen = ts
+	h.AgentVersion = latest.Info.Metadata.AgentVersion
+	if h.Online {
+		h.Sessions[len(h.Sessions)-1].End = ts
+	} else {
+		h.Sessions = append(h.Sessions, Session{Start: ts, End: ts})
+		h.Online = true
+	}
+}
+
+// active returns the peers which should be re-crawled in a new round.
+func (v *networkView) active(now time.Time, eviction time.Duration) []peer.ID {
+	v.m.Lock()
+	defer v.m.Unlock()
+
+	res := make([]peer.ID, 0, len(v.peers))
+	for id, h := range v.peers {
+		if eviction > 0 {
+			last := h.LastSeen
+			if last.IsZero() {
+				last = h.FirstDiscovered
+			}
+			if now.Sub(last) > eviction {
+				continue
+			}
+		}
+		res = append(res, id)
+	}
+	return res
+}
+
+func (v *networkView) snapshot() NetworkSnapshot {
+	v.m.Lock()
+	defer v.m.Unlock()
+
+	s := NetworkSnapshot{
+		Timestamp: time.Now(),
+		Round:     v.round,
+		Peers:     make(map[peer.ID]PeerHistory, len(v.peers)),
+	}
+	for id, h := range v.peers {
+		c := *h
+		c.Sessions = append([]Session(nil), h.Sessions...)
+		s.Peers[id] = c
+	}
+	return s
+}
+
+// CrawlContinuously crawls the network in rounds, until the given context is
+// cancelled.
+// The first round starts at the bootstrap peers and any peers added with
+// AddPeersToCrawl, every following round re-crawls all peers known so far,
+// except those evicted because of ContinuousConfig.OfflineEviction.
+// Each round behaves like CrawlNetworkContext, and its output is passed to
+// onRound once the round is finished.
+// Along the way, the history of every peer is recorded. Snapshots of this are
+// passed to onSnapshot every ContinuousConfig.SnapshotInterval, from a
+// separate goroutine.
+// The final snapshot is returned.
+// This requires CrawlManagerConfig.Continuous to be set.
+func (cm *CrawlManager) CrawlContinuously(ctx context.Context, onRound func(CrawlOutput), onSnapshot func(NetworkSnapshot)) (NetworkSnapshot, error) {
+	cfg := cm.config.Continuous
+	if cfg == nil {
+		return NetworkSnapshot{}, fmt.Errorf("continuous crawling is not configured")
+	}
+
+	view := newNetworkView()
+	cm.AddObserver(view)
+
+	var wg sync.WaitGroup
+	snapshotCtx, stopSnapshots := context.WithCancel(ctx)
+	if cfg.SnapshotInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(cfg.SnapshotInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-snapshotCtx.Done():
+					return
+				case <-ticker.C:
+					onSnapshot(view.snapshot())
+				}
+			}
+		}()
+	}
+
+	for round := 1; ; round++ {
+		if round > 1 {
+			err := cm.startRound(view.active(time.Now(), cfg.OfflineEviction))
+			if err != nil {
+				stopSnapshots()
+				wg.Wait()
+				return view.snapshot(), fmt.Errorf("unable to start round %d: %w", round, err)
+			}
+		}
+		view.setRound(round)
+		roundStart := time.Now()
+		cm.logger.WithFields(log.Fields{
+			"round": round,
+			"queue": cm.toCrawl.len(),
+		}).Info("Starting round of continuous crawl")
+
+		report := cm.CrawlNetworkContext(ctx)
+		onRound(report)
+
+		wait := time.NewTimer(time.Until(roundStart.Add(cfg.RoundInterval)))
+		select {
+		case <-ctx.Done():
+		case <-wait.C:
+		}
+		wait.Stop()
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	stopSnapshots()
+	wg.Wait()
+	return view.snapshot(), nil
+}
+
+// startRound resets the state of the crawl manager for a new round of a
+// continuous crawl, and queues the bootstrap peers and the given peers.
+func (cm *CrawlManager) startRound(peers []peer.ID) error {
+	policy, err := newSchedulingPolicy(cm.config.SchedulingPolicy)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	// Results of requests abandoned in the previous round are discarded, since
+	// nobody reads the old channels anymore.
+	cm.resultChan = make(chan nodeCrawlResult)
+	cm.abandoned = make(chan struct{})
+	cm.crawlsInProgress = make(map[peer.ID]time.Time)
+	cm.requeueOnFinish = make(map[peer.ID]struct{})
+	cm.crawled = make(map[peer.ID]nodeCrawlStatus)
+	cm.deferred = nil
+	cm.deferredUntil = make(map[peer.ID]time.Time)
+	cm.dialLimiter = newDialLimiter(cm.config.DialLimits)
+	cm.startTs = time.Time{}
+
+	oldAddrs := cm.toCrawl.addrInfo
+	cm.toCrawl = newToCrawlQueue(policy)
+	for _, p := range cm.bootstrapPeers {
+		cm.toCrawl.push(p, false)
+	}
+	for _, id := range peers {
+		cm.toCrawl.push(peer.AddrInfo{ID: id, Addrs: oldAddrs[id]}, false)
+	}
+
+	return nil
+}
+
+// networkSnapshotJSON is a helper struct to serialize a NetworkSnapshot to
+// JSON.
+type networkSnapshotJSON struct {
+	Timestamp time.Time                   `json:"timestamp"`
+	Round     int                         `json:"round"`
+	NumOnline int                         `json:"num_online"`
+	Peers     map[peer.ID]peerHistoryJSON `json:"peers"`
+}
+
+// peerHistoryJSON is a helper struct to serialize a PeerHistory to JSON.
+type peerHistoryJSON struct {
+	FirstDiscovered time.Time     `json:"first_discovered"`
+	FirstSeen       *time.Time    `json:"first_seen"`
+	LastSeen        *time.Time    `json:"last_seen"`
+	LastProbed      *time.Time    `json:"last_probed"`
+	Online          bool          `json:"online"`
+	AgentVersion    string        `json:"agent_version"`
+	Sessions        []sessionJSON `json:"sessions"`
+}
+
+// sessionJSON is a helper struct to serialize a Session to JSON.
+type sessionJSON struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// timeOrNil returns nil for the zero time.
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// WriteSnapshot writes the snapshot to the given path as JSON.
+func (s NetworkSnapshot) WriteSnapshot(path string) error {
+	out := networkSnapshotJSON{
+		Timestamp: s.Timestamp,
+		Round:     s.Round,
+		NumOnline: s.NumOnline(),
+		Peers:     make(map[peer.ID]peerHistoryJSON, len(s.Peers)),
+	}
+	for id, h := range s.Peers {
+		hj := peerHistoryJSON{
+			FirstDiscovered: h.FirstDiscovered,
+			FirstSeen:       timeOrNil(h.FirstSeen),
+			LastSeen:        timeOrNil(h.LastSeen),
+			LastProbed:      timeOrNil(h.LastProbed),
+			Online:          h.Online,
+			AgentVersion:    h.AgentVersion,
+			Sessions:        make([]sessionJSON, 0, len(h.Sessions)),
+		}
+		for _, session := range h.Sessions {
+			hj.Sessions = append(hj.Sessions, sessionJSON(session))
+		}
+		out.Peers[id] = hj
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("unable to create snapshot file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	err = json.NewEncoder(f).Encode(out)
+	if err != nil {
+		return fmt.Errorf("unable to write snapshot: %w", err)
+	}
+
+	return nil
+}
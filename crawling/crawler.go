@@ -2,6 +2,7 @@ package crawling
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -23,6 +24,10 @@ type CrawlerConfig struct {
 
 	InteractionTimeout  time.Duration `yaml:"interaction_timeout"`
 	InteractionAttempts uint          `yaml:"interaction_attempts"`
+
+	// The maximum number of buckets of a peer queried concurrently, each on
+	// its own DHT stream. Zero or one queries buckets one after another.
+	MaxStreams uint `yaml:"max_streams"`
 }
 
 func (c CrawlerConfig) check() error {
@@ -64,47 +69,158 @@ func newCrawler(h host.Host, c CrawlerConfig, ph *PreimageHandler) (*crawler, er
 }
 
 // HandlePeer (almost) implements Plugin, except for the return type.
-func (c *crawler) HandlePeer(p peer.AddrInfo) (*crawlData, error) {
+// If rec is not nil, the outcome of every interaction is recorded to it.
+// It also returns how long it took to open the first DHT stream.
+func (c *crawler) HandlePeer(p peer.AddrInfo, rec *probeRecordJSON) (*crawlData, PhaseTiming, error) {
 	// Roadmap:
 	// 1) Start a new stream = subprotocol exchange
 	// 2) Send FindNode(s)
 	// 3) Parse responses
 
 	// Create a new stream
-	var dhtStream network.Stream
+	pool := &streamPool{c: c, p: p.ID}
+	var streamTiming PhaseTiming
+	var dhtStream *findNodeStream
 	var err error
-	for i := uint(0); i < c.config.InteractionAttempts; i++ {
+	streamStartTs := time.Now()
+	for streamTiming.Attempts < c.config.InteractionAttempts {
+		streamTiming.Attempts++
 		ctx, cancel := context.WithTimeout(context.Background(), c.config.InteractionTimeout)
 		defer cancel()
-		dhtStream, err = c.h.NewStream(ctx, p.ID, c.config.ProtocolStrings...)
+		dhtStream, err = pool.open(ctx)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"err":    err,
-				"try":    i + 1,
+				"try":    streamTiming.Attempts,
 				"peerID": p.ID,
 			}).Debug("could not open stream")
 		} else {
 			break
 		}
 	}
+	streamTiming.Duration = time.Since(streamStartTs)
+	if err != nil {
+		err = classifyError(err, phaseStream)
+		rec.setStreamError(err)
+		return nil, streamTiming, fmt.Errorf("unable to open stream: %w", err)
+	}
+	pool.put(dhtStream, false)
+	defer pool.close()
+
+	data, err := c.crawlNeighbors(p.ID, func(ctx context.Context, cpl uint8) ([]byte, []peer.AddrInfo, error) {
+		target := c.preimageHandler.findPreImageForCPL(p.ID, cpl)
+		s, err := pool.get(ctx)
+		if err != nil {
+			err = fmt.Errorf("unable to open stream: %w", classifyError(err, phaseStream))
+			rec.addFindNode(cpl, target, nil, err)
+			return target, nil, err
+		}
+		peers, err := sendFindNode(ctx, s.r, target, s.s)
+		pool.put(s, err != nil)
+		rec.addFindNode(cpl, target, peers, err)
+		return target, peers, err
+	})
+	return data, streamTiming, err
+}
+
+// findNodeStream is a DHT stream to a peer, on which FIND_NODE requests are
+// sent one at a time.
+type findNodeStream struct {
+	s network.Stream
+	r msgio.ReadCloser
+}
+
+// streamPool holds the DHT streams to a single peer which are currently not
+// in use, so that buckets can be queried concurrently, one stream each.
+// Streams are opened on demand, so there are never more streams than
+// concurrent requests.
+type streamPool struct {
+	c *crawler
+	p peer.ID
+
+	m    sync.Mutex
+	idle []*findNodeStream
+}
+
+// open opens a new DHT stream to the peer.
+func (sp *streamPool) open(ctx context.Context) (*findNodeStream, error) {
+	s, err := sp.c.h.NewStream(ctx, sp.p, sp.c.config.ProtocolStrings...)
 	if err != nil {
-		return nil, fmt.Errorf("unable to open stream: %w", err)
+		return nil, err
+	}
+	return &findNodeStream{
+		s: s,
+		r: msgio.NewVarintReaderSize(s, network.MessageSizeMax),
+	}, nil
+}
+
+// get returns an idle stream, or opens a new one if there is none.
+func (sp *streamPool) get(ctx context.Context) (*findNodeStream, error) {
+	sp.m.Lock()
+	if len(sp.idle) != 0 {
+		s := sp.idle[len(sp.idle)-1]
+		sp.idle = sp.idle[:len(sp.idle)-1]
+		sp.m.Unlock()
+		return s, nil
+	}
+	sp.m.Unlock()
+
+	return sp.open(ctx)
+}
+
+// put returns a stream to the pool after use.
+// Streams on which a request failed are reset instead, because a late
+// response would be mistaken for the response to the next request.
+func (sp *streamPool) put(s *findNodeStream, failed bool) {
+	if failed {
+		_ = s.s.Reset()
+		s.r.Close()
+		return
+	}
+
+	sp.m.Lock()
+	defer sp.m.Unlock()
+	sp.idle = append(sp.idle, s)
+}
+
+// close closes all idle streams.
+func (sp *streamPool) close() {
+	sp.m.Lock()
+	defer sp.m.Unlock()
+	for _, s := range sp.idle {
+		_ = s.s.Close()
+		s.r.Close()
 	}
-	defer func() { _ = dhtStream.Close() }()
+	sp.idle = nil
+}
+
+// errNoNeighbors wraps the error of a peer for which a DHT stream was opened,
+// but none of its buckets could be crawled.
+var errNoNeighbors = errors.New("failed to extract peers")
+
+// findNodeFunc sends a single FIND_NODE request for the bucket with the given
+// common prefix length and returns the target key, if known, and the response.
+type findNodeFunc func(ctx context.Context, cpl uint8) ([]byte, []peer.AddrInfo, error)
 
+// crawlNeighbors obtains the neighbors of the given peer via findNode.
+// If MaxStreams is greater than one, findNode is called concurrently.
+// If some buckets could not be crawled, but others could, the crawl is partial
+// and the last error is kept in the result.
+func (c *crawler) crawlNeighbors(p peer.ID, findNode findNodeFunc) (*crawlData, error) {
 	crawlStartedTs := time.Now()
-	neighbors, err := c.fullNeighborCrawl(dhtStream, p.ID)
+	neighbors, buckets, err := c.fullNeighborCrawl(p, findNode)
 	if err != nil {
 		if len(neighbors) == 0 {
 			// We got nothing and a lot of things went wrong, might as well report that...
-			return nil, fmt.Errorf("failed to extract peers: %w", err)
+			return nil, fmt.Errorf("%w: %w", errNoNeighbors, err)
 		}
+		log.WithError(err).WithField("peer", p).Debug("crawled peer partially")
 	}
 
-	// We hide any errors if we got at least some peers.
-	// TODO maybe this is not optimal
 	return &crawlData{
 		neighbors:              neighbors,
+		buckets:                buckets,
+		err:                    err,
 		crawlStartedTimestamp:  crawlStartedTs,
 		crawlFinishedTimestamp: time.Now(),
 	}, nil
@@ -114,57 +230,88 @@ func (c *crawler) HandlePeer(p peer.AddrInfo) (*crawlData, error) {
 //
 // Asks the remote node for the closest peers to a given prefix the remote knows.
 // Iterates through the prefixes until no new peers are learned.
-// Returns an error if connecting fails, or message passing fails entirely.
-func (c *crawler) fullNeighborCrawl(s network.Stream, p peer.ID) ([]peer.AddrInfo, error) {
+// Up to MaxStreams buckets are queried concurrently, ahead of the bucket whose
+// response decides whether to go on. Responses are processed in order of
+// their prefix length, and responses for buckets past the one at which we stop
+// are discarded, so the result is the same as when querying one bucket after
+// another.
+// Returns the error of the last bucket that could not be crawled, if any.
+func (c *crawler) fullNeighborCrawl(p peer.ID, findNode findNodeFunc) ([]peer.AddrInfo, []bucketResult, error) {
 	// Start with a common prefix length of 0 and successively move to closer IDs until we either
 	// learn no new peers or our hard cap for the CPL pre-computation is reached.
 	var neighbors []peer.AddrInfo
+	var buckets []bucketResult
 	var err error
 	seenIDs := make(map[peer.ID]struct{})
 
-	recvReader := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
-	defer recvReader.Close()
+	maxStreams := int(c.config.MaxStreams)
+	if maxStreams < 1 {
+		maxStreams = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	type response struct {
+		bucket bucketResult
+		peers  []peer.AddrInfo
+	}
+	responses := make(chan response)
+	done := make(map[int]response)
+	next := 0
+	inFlight := 0
+	defer func() {
+		// Wait for the buckets queried ahead, so that findNode is not
+		// called after we return.
+		cancel()
+		for ; inFlight > 0; inFlight-- {
+			<-responses
+		}
+	}()
 
 	// We ask at least four times, or until we learn no new peers.
-	// TODO we could create parallel streams, one per CPL, and ask concurrently.
 	anyNewPeers := false
 	for i := 0; i < 4 || (i < MaxCPL && anyNewPeers); i++ {
 		anyNewPeers = false
-		target := c.preimageHandler.findPreImageForCPL(p, uint8(i))
-		log.WithFields(log.Fields{
-			"cpl":      i,
-			"destAddr": p,
-		}).Trace("Sending FindNode.")
-
-		var peerResponse []peer.AddrInfo
-		for i := uint(0); i < c.config.InteractionAttempts; i++ {
-			ctx, cancel := context.WithTimeout(context.Background(), c.config.InteractionTimeout)
-			defer cancel()
-			peerResponse, err = sendFindNode(ctx, recvReader, target, s)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"err":      err,
-					"try":      i + 1,
-					"destAddr": p,
-				}).Debug("failed to send FIND_NODE")
-			} else {
+
+		for ; next < MaxCPL && next < i+maxStreams && inFlight < maxStreams; next++ {
+			log.WithFields(log.Fields{
+				"cpl":      next,
+				"destAddr": p,
+			}).Trace("Sending FindNode.")
+			inFlight++
+			go func(cpl uint8) {
+				bucket, peers := c.queryBucket(ctx, p, cpl, findNode)
+				responses <- response{bucket: bucket, peers: peers}
+			}(uint8(next))
+		}
+		for {
+			if _, ok := done[i]; ok {
 				break
 			}
+			r := <-responses
+			inFlight--
+			done[int(r.bucket.cpl)] = r
 		}
-		if err != nil {
+		r := done[i]
+		delete(done, i)
+
+		if r.bucket.err != nil {
+			err = r.bucket.err
 			log.WithError(err).WithField("peer", p).WithField("bucket", i).Debug("failed to crawl bucket")
 		} else {
-			log.WithField("bucket", i).WithField("peers", peerResponse).WithField("peer", p).Debug("crawled bucket")
+			log.WithField("bucket", i).WithField("peers", r.peers).WithField("peer", p).Debug("crawled bucket")
 		}
 
-		for _, p := range peerResponse {
+		for _, p := range r.peers {
+			r.bucket.peers = append(r.bucket.peers, p.ID)
 			if _, ok := seenIDs[p.ID]; ok {
+				r.bucket.duplicates++
 				continue
 			}
 			seenIDs[p.ID] = struct{}{}
 			neighbors = append(neighbors, p)
 			anyNewPeers = true
 		}
+		buckets = append(buckets, r.bucket)
 		if anyNewPeers && i == 23 {
 			// This is not always an error: if we're too slow and the peer
 			// concurrently modifies its routing table, this will be triggered,
@@ -174,7 +321,40 @@ func (c *crawler) fullNeighborCrawl(s network.Stream, p peer.ID) ([]peer.AddrInf
 	}
 
 	// Everything went well (enough)
-	return neighbors, err
+	return neighbors, buckets, err
+}
+
+// queryBucket sends a FIND_NODE request for the bucket with the given common
+// prefix length via findNode, making up to InteractionAttempts attempts of up
+// to InteractionTimeout each.
+// It gives up early if ctx is cancelled.
+func (c *crawler) queryBucket(ctx context.Context, p peer.ID, cpl uint8, findNode findNodeFunc) (bucketResult, []peer.AddrInfo) {
+	res := bucketResult{
+		cpl:     cpl,
+		startTs: time.Now(),
+	}
+	var peers []peer.AddrInfo
+	for res.attempts < c.config.InteractionAttempts && ctx.Err() == nil {
+		res.attempts++
+		tryCtx, cancel := context.WithTimeout(ctx, c.config.InteractionTimeout)
+		sentTs := time.Now()
+		res.target, peers, res.err = findNode(tryCtx, cpl)
+		cancel()
+		if res.err == nil {
+			res.latency = time.Since(sentTs)
+			break
+		}
+		log.WithFields(log.Fields{
+			"err":      res.err,
+			"try":      res.attempts,
+			"destAddr": p,
+		}).Debug("failed to send FIND_NODE")
+	}
+	if res.err != nil {
+		res.err = classifyError(res.err, phaseFindNode)
+	}
+	res.endTs = time.Now()
+	return res, peers
 }
 
 // sendFindNode probes the remote node for neighborhood nodes.
@@ -234,7 +414,7 @@ func sendFindNode(ctx context.Context, recvReader msgio.Reader, target []byte, s
 		err = proto.Unmarshal(msg, &response)
 		if err != nil {
 			log.WithError(err).Warn("unable to unmarshal FIND_NODE response")
-			return nil, err
+			return nil, &classifiedError{code: ErrorCodeInvalidResponse, err: err}
 		}
 		recvReader.ReleaseMsg(msg)
 		peerInfo := pb.PBPeersToPeerInfos(response.GetCloserPeers())
@@ -1,47 +1,207 @@
 package crawling
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/libp2p/go-libp2p/core/protocol"
 	ma "github.com/multiformats/go-multiaddr"
 	log "github.com/sirupsen/logrus"
 )
 
+var (
+	// ErrCrawlDeadlineExceeded is recorded for peers which were still being
+	// probed when the crawl ended because MaxCrawlDuration or IdleTimeout was
+	// reached.
+	ErrCrawlDeadlineExceeded = errors.New("crawl deadline exceeded")
+
+	// ErrCrawlInterrupted is recorded for peers which were still being probed
+	// when the crawl was interrupted and the shutdown grace period expired.
+	ErrCrawlInterrupted = errors.New("crawl interrupted")
+)
+
+// isAbandoned returns whether the given error was recorded for a peer which
+// was still being probed when the crawl ended.
+func isAbandoned(err error) bool {
+	return errors.Is(err, ErrCrawlDeadlineExceeded) || errors.Is(err, ErrCrawlInterrupted)
+}
+
 // CrawlOutput is the output of a crawl.
+// See output.go for methods to access the results.
 type CrawlOutput struct {
 	nodes    map[peer.ID]nodeCrawlStatus
 	addrInfo map[peer.ID][]ma.Multiaddr
+	partial  bool
+
+	// How partially crawled peers are written to the peer graph and node
+	// cache.
+	partialCrawls PartialCrawlConfig
+
+	// Whether to write the bucket column of the peer graph.
+	peergraphBuckets bool
+
+	// Classifies peers by DHT mode.
+	dhtModes dhtModeClassifier
+
+	// The times at which the crawl was resumed from a checkpoint.
+	resumedAt []time.Time
 }
 
 // CrawlManagerConfig contains configuration for the crawl manager.
 type CrawlManagerConfig struct {
 	// Path to the preimage file.
+	// Only required if there are local workers, no preimages are passed to
+	// NewCrawlManagerWithPreimages and no recording is replayed.
 	PreimageFilePath string `yaml:"preimage_file_path"`
 
-	NumWorkers         uint           `yaml:"num_workers"`
+	// The number of local workers. This may be zero if there are remote
+	// workers.
+	NumWorkers uint `yaml:"num_workers"`
+
+	// Workers in other processes or on other machines, which run
+	// WorkerServers. Requests are distributed evenly among local and remote
+	// workers.
+	RemoteWorkers []RemoteWorkerConfig `yaml:"remote_workers"`
+
 	BootstrapPeers     []string       `yaml:"bootstrap_peers"`
 	ConcurrentRequests uint           `yaml:"concurrent_requests"`
 	WorkerConfig       WorkerConfig   `yaml:"worker_config"`
 	Plugins            []PluginConfig `yaml:"plugins"`
 	CrawlerConfig      CrawlerConfig  `yaml:"crawler_config"`
+
+	// How long to wait for in-flight requests when a crawl is interrupted.
+	// Requests that do not finish within this period are abandoned.
+	ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period"`
+
+	// If set, the crawl ends after this duration, even if peers remain to be
+	// crawled.
+	MaxCrawlDuration time.Duration `yaml:"max_crawl_duration"`
+
+	// If set, the crawl ends if no results were received for this duration.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+
+	// If set, the state of the crawl is periodically written to this file,
+	// from which the crawl can be resumed with RestoreCheckpoint.
+	// The file is compressed if its name ends in ".zst".
+	CheckpointFilePath string `yaml:"checkpoint_file_path"`
+
+	// How often to write a checkpoint.
+	CheckpointInterval time.Duration `yaml:"checkpoint_interval"`
+
+	// The order in which discovered peers are crawled, one of
+	// SchedulingFIFO (the default), SchedulingMostReferenced,
+	// SchedulingKeyspaceRoundRobin, or SchedulingAddressType.
+	SchedulingPolicy string `yaml:"scheduling_policy"`
+
+	// Observers to notify about events during the crawl.
+	// More observers can be added with AddObserver.
+	Observers []ObserverConfig `yaml:"observers"`
+
+	// When to probe peers again after a failed attempt.
+	Retry RetryConfig `yaml:"retry"`
+
+	// How to treat peers of which only some buckets could be crawled.
+	PartialCrawls PartialCrawlConfig `yaml:"partial_crawls"`
+
+	// Whether to add a column to the peer graph holding the bucket in whose
+	// response the target was first returned.
+	// This is off by default, to keep the format of the peer graph.
+	PeergraphBuckets bool `yaml:"peergraph_buckets"`
+
+	// Limits on probing peers behind the same IP address or subnet.
+	DialLimits DialLimitConfig `yaml:"dial_limits"`
+
+	// If set, CrawlContinuously can be used to crawl the network repeatedly.
+	Continuous *ContinuousConfig `yaml:"continuous"`
+
+	// If set, everything the local workers observe from peers, i.e., dial
+	// outcomes, identify data, FIND_NODE requests and responses and plugin
+	// results, is recorded to this file.
+	// The crawl can then be reproduced with ReplayFilePath.
+	// The file is compressed if its name ends in ".zst".
+	RecordFilePath string `yaml:"record_file_path"`
+
+	// If set, peers are not contacted. Instead, the local workers replay the
+	// recording in this file, written via RecordFilePath.
+	// The crawl starts at the peers the recorded crawl started at, instead of
+	// the bootstrap peers.
+	ReplayFilePath string `yaml:"replay_file_path"`
+}
+
+// PartialCrawlConfig configures how peers are treated of which only some
+// buckets could be crawled, e.g., because the stream broke halfway through.
+// By default, they are treated like peers that were crawled completely.
+type PartialCrawlConfig struct {
+	// Whether to leave the neighbors of such peers out of the peer graph.
+	ExcludeFromPeergraph bool `yaml:"exclude_from_peergraph"`
+
+	// Whether to leave such peers out of the node cache.
+	ExcludeFromNodeCache bool `yaml:"exclude_from_node_cache"`
+
+	// Whether to probe such peers again, like peers that failed, according
+	// to the retry configuration.
+	Retry bool `yaml:"retry"`
 }
 
 func (c *CrawlManagerConfig) check() error {
-	if len(c.PreimageFilePath) == 0 {
-		return fmt.Errorf("missing preimage file path")
-	}
-	if c.NumWorkers == 0 {
+	if c.NumWorkers == 0 && len(c.RemoteWorkers) == 0 {
 		return fmt.Errorf("missing or invalid num_workers")
 	}
+	for i, rw := range c.RemoteWorkers {
+		err := rw.check()
+		if err != nil {
+			return fmt.Errorf("invalid remote worker %d: %w", i, err)
+		}
+	}
 	if len(c.BootstrapPeers) == 0 {
 		return fmt.Errorf("missing bootstrap peers")
 	}
 	if c.ConcurrentRequests == 0 {
 		return fmt.Errorf("missing or invalid concurrent_requests")
 	}
+	if c.ShutdownGracePeriod < 0 {
+		return fmt.Errorf("invalid shutdown_grace_period")
+	}
+	if c.MaxCrawlDuration < 0 {
+		return fmt.Errorf("invalid max_crawl_duration")
+	}
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("invalid idle_timeout")
+	}
+	if len(c.CheckpointFilePath) != 0 && c.CheckpointInterval <= 0 {
+		return fmt.Errorf("missing or invalid checkpoint_interval")
+	}
+	err := c.Retry.check()
+	if err != nil {
+		return fmt.Errorf("invalid retry config: %w", err)
+	}
+	err = c.DialLimits.check()
+	if err != nil {
+		return fmt.Errorf("invalid dial limits: %w", err)
+	}
+	if c.PartialCrawls.Retry && !c.Retry.enabled() {
+		return fmt.Errorf("partial_crawls.retry requires retry.max_attempts greater than one")
+	}
+	if len(c.RecordFilePath) != 0 || len(c.ReplayFilePath) != 0 {
+		if len(c.RecordFilePath) != 0 && len(c.ReplayFilePath) != 0 {
+			return fmt.Errorf("record_file_path and replay_file_path are mutually exclusive")
+		}
+		if len(c.RemoteWorkers) != 0 {
+			return fmt.Errorf("recording and replaying are not supported with remote_workers")
+		}
+	}
+	if c.Continuous != nil {
+		err := c.Continuous.check()
+		if err != nil {
+			return fmt.Errorf("invalid continuous config: %w", err)
+		}
+		if len(c.CheckpointFilePath) != 0 {
+			return fmt.Errorf("checkpoints are not supported in continuous mode")
+		}
+	}
 	return nil
 }
 
@@ -49,10 +209,27 @@ func (c *CrawlManagerConfig) check() error {
 // they have.
 // It also knows if we should potentially re-crawl a peer because of address
 // changes since the last time we crawled.
+// The order in which queued peers are crawled is decided by a
+// schedulingPolicy.
 type toCrawlQueue struct {
-	queue    []peer.ID
+	policy   schedulingPolicy
 	inQueue  map[peer.ID]struct{}
 	addrInfo map[peer.ID][]ma.Multiaddr
+
+	// The peers found in the routing table of at least one other peer, as
+	// opposed to, e.g., bootstrap peers, with the addresses reported for
+	// them.
+	dhtAddrs dhtAddrReports
+}
+
+// newToCrawlQueue creates an empty queue with the given scheduling policy.
+func newToCrawlQueue(policy schedulingPolicy) *toCrawlQueue {
+	return &toCrawlQueue{
+		policy:   policy,
+		addrInfo: make(map[peer.ID][]ma.Multiaddr),
+		inQueue:  make(map[peer.ID]struct{}),
+		dhtAddrs: make(dhtAddrReports),
+	}
 }
 
 // numPeers returns the number of peers we know about.
@@ -72,8 +249,7 @@ func (q *toCrawlQueue) pop() peer.AddrInfo {
 		panic("empty queue")
 	}
 
-	var id peer.ID
-	id, q.queue = q.queue[0], q.queue[1:]
+	id := q.policy.next()
 	addr := q.addrInfo[id]
 	delete(q.inQueue, id)
 
@@ -83,24 +259,31 @@ func (q *toCrawlQueue) pop() peer.AddrInfo {
 	}
 }
 
+// enqueue adds the peer to the crawl queue, if it is not queued already.
+func (q *toCrawlQueue) enqueue(id peer.ID) {
+	if _, ok := q.inQueue[id]; ok {
+		return
+	}
+	q.inQueue[id] = struct{}{}
+	q.policy.add(id, q.addrInfo[id])
+}
+
 // push adds the peer's addresses to the cache and, if necessary, to the crawl
 // queue.
 func (q *toCrawlQueue) push(p peer.AddrInfo, force bool) {
 	if force {
 		// Just add it
-		q.queue = append(q.queue, p.ID)
-		q.inQueue[p.ID] = struct{}{}
 		newAddrs := filterOutOldAddresses(q.addrInfo[p.ID], stripLocalAddrs(p.Addrs))
 		q.addrInfo[p.ID] = append(q.addrInfo[p.ID], newAddrs...)
+		q.enqueue(p.ID)
 		return
 	}
 
 	oldAddrs, ok := q.addrInfo[p.ID]
 	if !ok {
 		// Not known at all, just add
-		q.queue = append(q.queue, p.ID)
-		q.inQueue[p.ID] = struct{}{}
 		q.addrInfo[p.ID] = p.Addrs
+		q.enqueue(p.ID)
 		return
 	}
 
@@ -115,10 +298,7 @@ func (q *toCrawlQueue) push(p peer.AddrInfo, force bool) {
 	q.addrInfo[p.ID] = append(q.addrInfo[p.ID], newAddrs...)
 
 	// If not in queue, re-add (with new addresses)
-	if _, ok := q.inQueue[p.ID]; !ok {
-		q.inQueue[p.ID] = struct{}{}
-		q.queue = append(q.queue, p.ID)
-	}
+	q.enqueue(p.ID)
 }
 
 // A worker is a libp2p host which is used to crawl the network.
@@ -126,7 +306,9 @@ func (q *toCrawlQueue) push(p peer.AddrInfo, force bool) {
 // It should also execute any plugins on connectable nodes.
 type worker interface {
 	// crawlPeer crawls the given peer.
-	crawlPeer(peer.AddrInfo) (*rawNodeInformation, error)
+	// It also returns the outcome of dialing each address of the peer, if
+	// the worker dialed them separately.
+	crawlPeer(peer.AddrInfo) (*rawNodeInformation, []addrDial, error)
 
 	// stop shuts down the worker cleanly.
 	stop() error
@@ -136,15 +318,24 @@ type worker interface {
 // The fields err and node are mutually exclusive.
 type nodeCrawlResult struct {
 	id      peer.ID
+	addrs   []ma.Multiaddr
+	worker  string
 	startTs time.Time
 	endTs   time.Time
+	dials   []addrDial
 	err     error
 	node    *rawNodeInformation
 }
 
 // rawNodeInformation stores all information from probing a peer
+// If identifyErr is set, info holds whatever we know anyway.
 type rawNodeInformation struct {
-	info          peerMetadata
+	connectedAddr ma.Multiaddr
+	info          PeerMetadata
+	identifyErr   error
+	timings       Timings
+	pingSamples   []time.Duration
+	pingErr       error
 	crawlData     crawlResult
 	pluginResults map[string]pluginResult
 }
@@ -160,12 +351,35 @@ type crawlResult struct {
 
 // crawlData contains the data obtained through crawling a peer, notably its
 // neighborhood.
+// If some buckets could not be crawled, err holds the last error.
 type crawlData struct {
 	neighbors              []peer.AddrInfo
+	buckets                []bucketResult
+	err                    error
 	crawlStartedTimestamp  time.Time
 	crawlFinishedTimestamp time.Time
 }
 
+// bucketResult describes querying a single bucket of a peer's routing table.
+// The fields peers and err are mutually exclusive.
+type bucketResult struct {
+	cpl      uint8
+	startTs  time.Time
+	endTs    time.Time
+	attempts uint
+	err      error
+
+	// The key the FIND_NODE requests were sent for, if known.
+	target []byte
+
+	// The peers in the response, in order, how many of them were already
+	// returned for a bucket with a smaller common prefix length or earlier
+	// in the same response, and how long it took to receive the response.
+	peers      []peer.ID
+	duplicates int
+	latency    time.Duration
+}
+
 // pluginResult encapsulates the result of calling a plugin on a peer.
 // The fields err and result are mutually exclusive.
 type pluginResult struct {
@@ -177,97 +391,241 @@ type pluginResult struct {
 
 // nodeCrawlStatus is our knowledge of a peer, after trying to probe it at least
 // once.
+// The fields startTs, endTs, err and result describe the best attempt, see
+// mergeAttempts.
 // The fields err and result are mutually exclusive.
 type nodeCrawlStatus struct {
 	startTs time.Time
 	endTs   time.Time
+	worker  string
 	err     error
 	result  *nodeInformation
+
+	// All attempts to probe the peer, oldest first.
+	attempts []crawlAttempt
 }
 
 // nodeInformation holds any information we know about a node.
 // Most notably, this does not store addresses of DHT neighbors, because they
 // are potentially big.
 // The fields crawlDataError and crawlNeighbors are mutually
-// exclusive.
+// exclusive. If crawlDataPartialError is set, only some buckets could be
+// crawled, see crawlState.
 type nodeInformation struct {
-	info          peerMetadata
+	connectedAddr ma.Multiaddr
+	info          PeerMetadata
+	identifyError error
+	timings       Timings
+	pingSamples   []time.Duration
+	pingError     error
 	pluginResults map[string]pluginResult
 
 	crawlDataError   error
 	crawlDataBeginTs time.Time
 	crawlDataEndTs   time.Time
 	crawlNeighbors   []peer.ID
-}
-
-type peerMetadata struct {
-	AgentVersion string
+	crawlBuckets     []bucketResult
 
-	SupportedProtocols []protocol.ID
+	crawlDataPartialError error
 }
 
 // A CrawlManager manages crawling the network.
 // It contains multiple workers, with a libp2p node each, which are used to
 // execute requests concurrently.
+// Workers are either local, or remote workers running a WorkerServer.
 type CrawlManager struct {
+	config      CrawlManagerConfig
 	resultChan  chan nodeCrawlResult
 	tokenBucket chan int
 	workers     []worker
 
-	crawlsInProgress map[peer.ID]struct{}
+	// The names of the workers, by index, as recorded in the output.
+	workerNames []string
+
+	bootstrapPeers []peer.AddrInfo
+
+	// abandoned is closed once we stop waiting for in-flight requests.
+	abandoned chan struct{}
+
+	crawlsInProgress map[peer.ID]time.Time
 	crawled          map[peer.ID]nodeCrawlStatus
 	toCrawl          *toCrawlQueue
+
+	// Peers which were queued again while being crawled. They are queued
+	// once the running crawl has finished.
+	requeueOnFinish map[peer.ID]struct{}
+
+	// Peers which must not be probed before a certain time, e.g., because
+	// of a retry backoff. They are queued again once their time has come.
+	deferred      retryHeap
+	deferredUntil map[peer.ID]time.Time
+
+	dialLimiter *dialLimiter
+
+	// When the crawl was started, and, if resumed from checkpoints, when it
+	// was resumed.
+	startTs   time.Time
+	resumedAt []time.Time
+
+	stream    *StreamingWriter
+	observers []Observer
+
+	// Records what the local workers observe, if configured.
+	recorder *recorder
+
+	logger *log.Entry
 }
 
 // NewCrawlManager creates a new CrawlManager.
 // This attempts to create the specified number of workers and plugins, which
 // may fail.
 func NewCrawlManager(config CrawlManagerConfig) (*CrawlManager, error) {
+	return NewCrawlManagerWithPreimages(config, nil, nil)
+}
+
+// NewCrawlManagerWithPreimages creates a new CrawlManager which uses the given
+// preimages instead of loading them from the configured file, and logs via the
+// given logger.
+// This allows multiple CrawlManagers, e.g., for different networks, to share
+// the preimages and tell their log messages apart. If preimages is nil, they
+// are loaded as by NewCrawlManager. If logger is nil, the standard logger is
+// used.
+func NewCrawlManagerWithPreimages(config CrawlManagerConfig, preimages *PreimageHandler, logger *log.Entry) (*CrawlManager, error) {
+	return newCrawlManager(config, preimages, nil, logger)
+}
+
+// NewCrawlManagerWithNetwork creates a new CrawlManager whose local workers
+// probe peers via the given Network instead of libp2p, e.g., to test the
+// crawler against a simulated network.
+// Preimages and plugins are not used, and remote workers and replaying are not
+// supported. The other settings apply as usual.
+func NewCrawlManagerWithNetwork(config CrawlManagerConfig, network Network) (*CrawlManager, error) {
+	if len(config.RemoteWorkers) != 0 || len(config.ReplayFilePath) != 0 {
+		return nil, fmt.Errorf("invalid config: remote_workers and replay_file_path are not supported with a network")
+	}
+	return newCrawlManager(config, nil, network, nil)
+}
+
+// newCrawlManager creates a new CrawlManager.
+// Local workers use the given network, if it is not nil, or libp2p hosts
+// otherwise.
+// The logger may be nil, in which case the standard logger is used.
+func newCrawlManager(config CrawlManagerConfig, preimages *PreimageHandler, network Network, logger *log.Entry) (*CrawlManager, error) {
 	err := config.check()
 	if err != nil {
 		return nil, fmt.Errorf("invalid config: %w", err)
 	}
+	if config.NumWorkers != 0 && preimages == nil && len(config.PreimageFilePath) == 0 && len(config.ReplayFilePath) == 0 && network == nil {
+		return nil, fmt.Errorf("invalid config: missing preimage file path")
+	}
 
-	// Load preimageHandler
-	preimageHandler, err := LoadPreimages(config.PreimageFilePath)
+	policy, err := newSchedulingPolicy(config.SchedulingPolicy)
 	if err != nil {
-		return nil, fmt.Errorf("unable to load preimages: %w", err)
+		return nil, fmt.Errorf("invalid config: %w", err)
 	}
-	log.WithField("path", config.PreimageFilePath).WithField("num", len(preimageHandler.preimages)).Info("loaded preimages")
 
+	numWorkers := config.NumWorkers + uint(len(config.RemoteWorkers))
 	cm := &CrawlManager{
+		config:           config,
 		resultChan:       make(chan nodeCrawlResult),
-		tokenBucket:      make(chan int, config.NumWorkers*config.ConcurrentRequests),
+		abandoned:        make(chan struct{}),
+		tokenBucket:      make(chan int, config.ConcurrentRequests),
 		crawled:          make(map[peer.ID]nodeCrawlStatus),
-		crawlsInProgress: make(map[peer.ID]struct{}),
-		toCrawl: &toCrawlQueue{
-			queue:    nil,
-			addrInfo: make(map[peer.ID][]ma.Multiaddr),
-			inQueue:  make(map[peer.ID]struct{}),
-		},
+		crawlsInProgress: make(map[peer.ID]time.Time),
+		requeueOnFinish:  make(map[peer.ID]struct{}),
+		toCrawl:          newToCrawlQueue(policy),
+		deferredUntil:    make(map[peer.ID]time.Time),
+		dialLimiter:      newDialLimiter(config.DialLimits),
+		logger:           logger,
+	}
+	if cm.logger == nil {
+		cm.logger = log.NewEntry(log.StandardLogger())
+	}
+
+	// Create observers
+	cm.observers, err = ObserversFromObserverConfigs(config.Observers)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create observers: %w", err)
 	}
 
 	// Create workers
+	var r *recording
+	if len(config.ReplayFilePath) != 0 {
+		r, err = loadRecording(config.ReplayFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load recording: %w", err)
+		}
+		cm.bootstrapPeers = r.header.Peers
+	}
+	if len(config.RecordFilePath) != 0 {
+		cm.recorder, err = newRecorder(config.RecordFilePath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.NumWorkers != 0 && r == nil && network == nil && preimages == nil {
+		preimages, err = LoadPreimages(config.PreimageFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load preimages: %w", err)
+		}
+		cm.logger.WithField("path", config.PreimageFilePath).WithField("num", len(preimages.preimages)).Info("loaded preimages")
+	}
 	for i := uint(0); i < config.NumWorkers; i++ {
-		worker, err := NewLibp2pWorker(config.WorkerConfig, config.Plugins, preimageHandler, config.CrawlerConfig)
+		var w worker
+		name := fmt.Sprintf("local-%d", i)
+		switch {
+		case r != nil:
+			w, err = newReplayWorker(r, config.CrawlerConfig)
+			name = fmt.Sprintf("replay-%d", i)
+		case network != nil:
+			var nw *networkWorker
+			nw, err = newNetworkWorker(network, config.WorkerConfig, config.CrawlerConfig)
+			if err == nil {
+				nw.recorder = cm.recorder
+				w = nw
+			}
+		default:
+			var lw *Libp2pWorker
+			lw, err = NewLibp2pWorker(config.WorkerConfig, config.Plugins, preimages, config.CrawlerConfig)
+			if err == nil {
+				lw.recorder = cm.recorder
+				w = lw
+			}
+		}
 		if err != nil {
 			return nil, fmt.Errorf("unable to create worker: %w", err)
 		}
+		cm.workers = append(cm.workers, w)
+		cm.workerNames = append(cm.workerNames, name)
+	}
+	requestsPerWorker := int((config.ConcurrentRequests + numWorkers - 1) / numWorkers)
+	for _, rwConfig := range config.RemoteWorkers {
+		worker, err := newRemoteWorker(rwConfig, requestsPerWorker)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to remote worker %s: %w", rwConfig.URL, err)
+		}
+		cm.logger.WithField("url", rwConfig.URL).WithField("name", worker.name).Info("connected to remote worker")
 		cm.workers = append(cm.workers, worker)
+		cm.workerNames = append(cm.workerNames, worker.name)
 	}
 
 	// Create concurrent work tokens, round-robin assign the workers by ID
 	for i := uint(0); i < config.ConcurrentRequests; i++ {
-		cm.tokenBucket <- int(i % config.NumWorkers)
+		cm.tokenBucket <- int(i % numWorkers)
 	}
 
 	// Parse and add bootstrap peers to queue
-	for _, maddr := range config.BootstrapPeers {
-		pinfo, err := parsePeerString(maddr)
-		if err != nil {
-			return nil, fmt.Errorf("unable to parse bootstrap peer address: %w", err)
+	if len(config.ReplayFilePath) == 0 {
+		for _, maddr := range config.BootstrapPeers {
+			pinfo, err := parsePeerString(maddr)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse bootstrap peer address: %w", err)
+			}
+			cm.bootstrapPeers = append(cm.bootstrapPeers, *pinfo)
 		}
-		cm.toCrawl.push(*pinfo, false)
+	}
+	for _, p := range cm.bootstrapPeers {
+		cm.toCrawl.push(p, false)
 	}
 
 	return cm, nil
@@ -277,16 +635,60 @@ func NewCrawlManager(config CrawlManagerConfig) (*CrawlManager, error) {
 // This must be called before CrawlNetwork.
 func (cm *CrawlManager) AddPeersToCrawl(peers []peer.AddrInfo) {
 	for _, p := range peers {
+		_, known := cm.toCrawl.addrInfo[p.ID]
 		cm.toCrawl.push(p, false)
+		if !known {
+			for _, o := range cm.observers {
+				o.OnPeerDiscovered(p, "")
+			}
+		}
 	}
 }
 
+// AddObserver registers an observer to be notified about events during the
+// crawl, in addition to the observers from the config.
+// This must be called before CrawlNetwork.
+// The observer is shut down together with the CrawlManager.
+func (cm *CrawlManager) AddObserver(o Observer) {
+	cm.observers = append(cm.observers, o)
+}
+
+// StreamResultsTo makes the CrawlManager append each result to the given
+// StreamingWriter as soon as it arrives.
+// This must be called before CrawlNetwork.
+// To save memory, neighbor lists are then not kept in the CrawlOutput, i.e.,
+// the peer graph must be produced through the StreamingWriter.
+func (cm *CrawlManager) StreamResultsTo(w *StreamingWriter) {
+	w.excludePartial = cm.config.PartialCrawls.ExcludeFromPeergraph
+	w.buckets = cm.config.PeergraphBuckets
+	cm.stream = w
+}
+
+// StartTime returns the time at which the crawl was started.
+// If the crawl was resumed from a checkpoint, this is the start time of the
+// original crawl. Otherwise, it is zero until CrawlNetwork is called.
+func (cm *CrawlManager) StartTime() time.Time {
+	return cm.startTs
+}
+
 // Stop shuts down all workers cleanly.
 func (cm *CrawlManager) Stop() error {
 	for _, worker := range cm.workers {
 		err := worker.stop()
 		if err != nil {
-			log.WithError(err).Warn("unable to stop worker")
+			cm.logger.WithError(err).Warn("unable to stop worker")
+		}
+	}
+	for _, o := range cm.observers {
+		err := o.Shutdown()
+		if err != nil {
+			cm.logger.WithError(err).Warn("unable to shut down observer")
+		}
+	}
+	if cm.recorder != nil {
+		err := cm.recorder.close()
+		if err != nil {
+			cm.logger.WithError(err).Warn("unable to close recording")
 		}
 	}
 
@@ -299,45 +701,108 @@ func (cm *CrawlManager) Stop() error {
 // Nodes are contacted only once, unless a previous connection attempt failed
 // and new addresses have been learned since.
 func (cm *CrawlManager) CrawlNetwork() CrawlOutput {
+	return cm.CrawlNetworkContext(context.Background())
+}
+
+// CrawlNetworkContext crawls the network like CrawlNetwork, until the crawl is
+// finished or the given context is cancelled.
+// If the context is cancelled, no new requests are dispatched.
+// In-flight requests are given ShutdownGracePeriod to finish, after which
+// they are abandoned. The returned CrawlOutput is then marked as partial.
+// If MaxCrawlDuration or IdleTimeout are configured, the crawl also ends once
+// either of them is reached. In-flight requests are then abandoned
+// immediately. If requests were abandoned or peers remain in the queue, the
+// output is marked as partial.
+// Abandoned requests are recorded as attempts with ErrCrawlInterrupted or
+// ErrCrawlDeadlineExceeded, respectively.
+// A CrawlManager can only crawl once, see CrawlContinuously for repeated
+// crawls.
+func (cm *CrawlManager) CrawlNetworkContext(ctx context.Context) CrawlOutput {
 	// Plan of action
 	// 1. Add bootstraps to overflow
 	// 2. Start dispatch loop
 	//  2.1 get new nodes from resultChan and check if we need to crawl them, if yes: add to toCrawl
 	//  2.2 if we can dispatch a crawl: dispatch from toCrawl
-	//  2.3 break loop: idleTimer fired | (toCrawl empty && no request are out && knowQueue empty)
+	//  2.3 break loop: idleTimer fired | deadline reached | (toCrawl empty && no request are out && knowQueue empty)
 	//  return data
-	log.Info("Starting crawl...")
+	cm.logger.Info("Starting crawl...")
+	if cm.startTs.IsZero() {
+		cm.startTs = time.Now()
+	}
+	if cm.recorder != nil {
+		err := cm.recorder.start(cm.startTs, cm.queuedPeers())
+		if err != nil {
+			cm.logger.WithError(err).Error("unable to start recording")
+		}
+	}
 
 	infoTicker := time.NewTicker(20 * time.Second)
 	defer infoTicker.Stop()
 
+	// A nil channel blocks forever, which disables the respective case.
+	var checkpoint <-chan time.Time
+	if len(cm.config.CheckpointFilePath) != 0 {
+		checkpointTicker := time.NewTicker(cm.config.CheckpointInterval)
+		defer checkpointTicker.Stop()
+		checkpoint = checkpointTicker.C
+	}
+
+	var deadline, idle <-chan time.Time
+	if cm.config.MaxCrawlDuration > 0 {
+		deadlineTimer := time.NewTimer(cm.config.MaxCrawlDuration)
+		defer deadlineTimer.Stop()
+		deadline = deadlineTimer.C
+	}
+	var idleTimer *time.Timer
+	if cm.config.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(cm.config.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
 	for cm.toCrawl.len() != 0 ||
-		len(cm.crawlsInProgress) != 0 {
+		len(cm.crawlsInProgress) != 0 ||
+		cm.deferred.Len() != 0 {
 
 		select {
-		case report := <-cm.resultChan:
-			// We have new information incoming
-			if _, ok := cm.crawlsInProgress[report.id]; !ok {
-				panic("received result for untracked crawl")
+		case <-ctx.Done():
+			cm.logger.WithField("requests in flight", len(cm.crawlsInProgress)).Info("Crawl interrupted, waiting for in-flight requests...")
+			cm.drain(cm.config.ShutdownGracePeriod)
+			if len(cm.config.CheckpointFilePath) != 0 {
+				// Peers abandoned just now will be probed again on resume.
+				err := cm.writeCheckpoint()
+				if err != nil {
+					cm.logger.WithError(err).Error("unable to write checkpoint")
+				}
 			}
-			delete(cm.crawlsInProgress, report.id)
+			return cm.createPartialReport(true)
 
-			// Insert into our "database"
-			cm.upsertCrawlResult(report)
+		case <-deadline:
+			cm.logger.WithFields(log.Fields{
+				"requests in flight": len(cm.crawlsInProgress),
+				"to-crawl-queue":     cm.toCrawl.len(),
+			}).Warn("Maximum crawl duration reached, ending crawl")
+			inFlight := len(cm.crawlsInProgress) != 0
+			cm.abandon(ErrCrawlDeadlineExceeded)
+			return cm.createPartialReport(inFlight || cm.toCrawl.len() != 0 || cm.deferred.Len() != 0)
 
-			if report.err != nil {
-				log.WithFields(log.Fields{"Error": report.err}).Debug("Error while crawling")
-				continue
-			}
+		case <-idle:
+			cm.logger.WithFields(log.Fields{
+				"requests in flight": len(cm.crawlsInProgress),
+				"to-crawl-queue":     cm.toCrawl.len(),
+			}).Warn("No results received within idle timeout, ending crawl")
+			inFlight := len(cm.crawlsInProgress) != 0
+			cm.abandon(ErrCrawlDeadlineExceeded)
+			return cm.createPartialReport(inFlight || cm.toCrawl.len() != 0 || cm.deferred.Len() != 0)
 
-			// Add new peers to queue
-			if report.node.crawlData.result != nil {
-				for _, addrInfo := range report.node.crawlData.result.neighbors {
-					cm.handleNewNode(addrInfo)
-				}
+		case report := <-cm.resultChan:
+			// We have new information incoming
+			cm.handleResult(report)
+			if idleTimer != nil {
+				idleTimer.Reset(cm.config.IdleTimeout)
 			}
 
-			log.WithFields(log.Fields{
+			cm.logger.WithFields(log.Fields{
 				"Current Request": len(cm.crawlsInProgress),
 				"toCrawl":         cm.toCrawl.len(),
 				"Reports":         len(cm.resultChan),
@@ -345,24 +810,32 @@ func (cm *CrawlManager) CrawlNetwork() CrawlOutput {
 
 		case id := <-cm.tokenBucket:
 			// We have an available worker
+			now := time.Now()
+			cm.releaseDeferred(now)
 			if cm.toCrawl.len() > 0 {
 				node := cm.toCrawl.pop()
 
 				// Check if we're already crawling that node
 				if _, ok := cm.crawlsInProgress[node.ID]; ok {
-					log.WithFields(log.Fields{"node": node.ID}).Debug("already being crawled, not dispatching crawl request")
+					cm.logger.WithFields(log.Fields{"node": node.ID}).Debug("already being crawled, queueing again once finished")
 
-					// Return to queue, maybe the crawl fails
-					cm.toCrawl.push(node, true)
+					// Return to queue once the crawl finished, maybe it fails
+					cm.requeueOnFinish[node.ID] = struct{}{}
 					cm.tokenBucket <- id
 				} else {
 					// Check if we crawled the node already
-					if state, ok := cm.crawled[node.ID]; !ok || (ok && state.err != nil) || (ok && state.err == nil && state.result.crawlDataError != nil) {
-						log.WithFields(log.Fields{"node": node.ID}).Debug("dispatching crawl request")
-						cm.crawlsInProgress[node.ID] = struct{}{}
-						go cm.dispatch(node, id)
+					if !cm.crawledEnough(node.ID) && cm.attemptAllowed(node.ID, now) {
+						if ok, retryAt := cm.dialLimiter.acquire(node, now); ok {
+							cm.logger.WithFields(log.Fields{"node": node.ID}).Debug("dispatching crawl request")
+							cm.crawlsInProgress[node.ID] = time.Now()
+							go cm.dispatch(node, id, cm.resultChan, cm.abandoned)
+						} else {
+							cm.logger.WithFields(log.Fields{"node": node.ID, "until": retryAt}).Debug("dial limit reached, deferring crawl request")
+							cm.deferPeer(node.ID, retryAt)
+							cm.tokenBucket <- id
+						}
 					} else {
-						log.WithFields(log.Fields{"node": node.ID}).Debug("already crawled, not dispatching crawl request")
+						cm.logger.WithFields(log.Fields{"node": node.ID}).Debug("already crawled or no attempt allowed, not dispatching crawl request")
 						cm.tokenBucket <- id
 					}
 				}
@@ -373,113 +846,295 @@ func (cm *CrawlManager) CrawlNetwork() CrawlOutput {
 				time.Sleep(10 * time.Millisecond)
 			}
 
-		case <-infoTicker.C:
-			numConnectable := 0
-			numCrawlable := 0
-			for _, status := range cm.crawled {
-				if status.err == nil {
-					numConnectable++
-					if status.result.crawlDataError == nil {
-						numCrawlable++
-					}
-				}
+		case <-checkpoint:
+			err := cm.writeCheckpoint()
+			if err != nil {
+				cm.logger.WithError(err).Error("unable to write checkpoint")
 			}
-			log.WithFields(log.Fields{
+
+		case <-infoTicker.C:
+			stats := computeStats(cm.crawled, cm.dhtModes())
+			cm.logger.WithFields(log.Fields{
 				"discovered nodes":            cm.toCrawl.numPeers(),
 				"available workers":           len(cm.tokenBucket),
 				"requests in flight":          len(cm.crawlsInProgress),
 				"to-crawl-queue":              cm.toCrawl.len(),
-				"connectable nodes":           numConnectable,
-				"connectable+crawlable nodes": numCrawlable,
+				"connectable nodes":           stats.NumConnectable,
+				"connectable+crawlable nodes": stats.NumCrawlable,
 			}).Info("Periodic info on crawl status")
 		}
 	}
 
+	if len(cm.config.CheckpointFilePath) != 0 {
+		// The crawl is finished, there is nothing to resume.
+		err := os.Remove(cm.config.CheckpointFilePath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			cm.logger.WithError(err).Warn("unable to remove checkpoint")
+		}
+	}
+
 	return cm.createReport()
 }
 
+// queuedPeers returns the queued peers with their addresses, in the order in
+// which they would be crawled.
+func (cm *CrawlManager) queuedPeers() []peer.AddrInfo {
+	var res []peer.AddrInfo
+	for _, id := range cm.toCrawl.policy.queued() {
+		res = append(res, peer.AddrInfo{ID: id, Addrs: cm.toCrawl.addrInfo[id]})
+	}
+	return res
+}
+
+// handleResult processes the result of a crawl request.
+func (cm *CrawlManager) handleResult(report nodeCrawlResult) {
+	if _, ok := cm.crawlsInProgress[report.id]; !ok {
+		panic("received result for untracked crawl")
+	}
+	delete(cm.crawlsInProgress, report.id)
+	cm.dialLimiter.release(report.id, time.Now())
+
+	// Insert into our "database"
+	cm.upsertCrawlResult(report)
+	cm.scheduleRetry(report.id)
+
+	if report.err != nil {
+		cm.logger.WithFields(log.Fields{"Error": report.err}).Debug("Error while crawling")
+		return
+	}
+
+	// Add new peers to queue
+	if report.node.crawlData.result != nil {
+		for _, addrInfo := range report.node.crawlData.result.neighbors {
+			cm.handleNewNode(addrInfo, report.id)
+		}
+	}
+}
+
+// drain waits up to the given grace period for in-flight requests to finish,
+// without dispatching new ones.
+// Requests still in flight afterwards are abandoned.
+func (cm *CrawlManager) drain(gracePeriod time.Duration) {
+	timer := time.NewTimer(gracePeriod)
+	defer timer.Stop()
+
+	for len(cm.crawlsInProgress) != 0 {
+		select {
+		case report := <-cm.resultChan:
+			cm.handleResult(report)
+		case <-timer.C:
+			cm.abandon(ErrCrawlInterrupted)
+			return
+		}
+	}
+	cm.abandon(ErrCrawlInterrupted)
+}
+
+// abandon stops waiting for in-flight requests.
+// For peers which are still being crawled, an attempt with the given error is
+// recorded. It ranks below every other attempt, so the outcome of earlier
+// attempts is kept.
+func (cm *CrawlManager) abandon(reason error) {
+	if len(cm.crawlsInProgress) != 0 {
+		cm.logger.WithField("requests in flight", len(cm.crawlsInProgress)).Warn("Abandoning in-flight requests")
+	}
+	close(cm.abandoned)
+
+	now := time.Now()
+	for id, startTs := range cm.crawlsInProgress {
+		cm.upsertCrawlResult(nodeCrawlResult{
+			id:      id,
+			addrs:   cm.toCrawl.addrInfo[id],
+			startTs: startTs,
+			endTs:   now,
+			err:     reason,
+		})
+	}
+	cm.crawlsInProgress = make(map[peer.ID]time.Time)
+	cm.dialLimiter = newDialLimiter(cm.config.DialLimits)
+}
+
 func (cm *CrawlManager) upsertCrawlResult(report nodeCrawlResult) {
-	// TODO maybe modify existing entry with new information?
-	ncs := nodeCrawlStatus{
-		result:  nil,
+	attempt := crawlAttempt{
 		startTs: report.startTs,
 		endTs:   report.endTs,
+		addrs:   report.addrs,
+		worker:  report.worker,
+		dials:   report.dials,
 		err:     report.err,
 	}
 	if report.node != nil {
-		ncs.result = new(nodeInformation)
-		ncs.result.pluginResults = report.node.pluginResults
-		ncs.result.info = report.node.info
-		ncs.result.crawlDataError = report.node.crawlData.err
-		ncs.result.crawlDataBeginTs = report.node.crawlData.beginTimestamp
-		ncs.result.crawlDataEndTs = report.node.crawlData.endTimestamp
+		attempt.result = new(nodeInformation)
+		attempt.result.pluginResults = report.node.pluginResults
+		attempt.result.connectedAddr = report.node.connectedAddr
+		attempt.result.info = report.node.info
+		attempt.result.identifyError = report.node.identifyErr
+		attempt.result.timings = report.node.timings
+		attempt.result.pingSamples = report.node.pingSamples
+		attempt.result.pingError = report.node.pingErr
+		attempt.result.crawlDataError = report.node.crawlData.err
+		attempt.result.crawlDataBeginTs = report.node.crawlData.beginTimestamp
+		attempt.result.crawlDataEndTs = report.node.crawlData.endTimestamp
 		if report.node.crawlData.result != nil {
 			for _, p := range report.node.crawlData.result.neighbors {
-				ncs.result.crawlNeighbors = append(ncs.result.crawlNeighbors, p.ID)
+				attempt.result.crawlNeighbors = append(attempt.result.crawlNeighbors, p.ID)
 			}
+			attempt.numNeighbors = len(attempt.result.crawlNeighbors)
+			attempt.result.crawlBuckets = report.node.crawlData.result.buckets
+			attempt.result.crawlDataPartialError = report.node.crawlData.result.err
 		}
 	}
+	if err := attempt.lastError(); err != nil {
+		attempt.retryable = cm.config.Retry.retryable(err)
+	}
+	ncs := mergeAttempts(append(cm.crawled[report.id].attempts, attempt))
+
+	if len(cm.observers) != 0 {
+		status := ncs.toNodeStatus(report.id, cm.dhtModes())
+		for _, o := range cm.observers {
+			o.OnCrawlFinished(status)
+		}
+	}
+
+	if cm.stream != nil {
+		err := cm.stream.write(report.id, ncs, cm.toCrawl.addrInfo[report.id], cm.dhtModes())
+		if err != nil {
+			cm.logger.WithError(err).WithField("peer", report.id).Error("unable to stream result")
+		}
+		if ncs.result != nil {
+			// The peer graph lives on disk now.
+			ncs.result.crawlNeighbors = nil
+			for i := range ncs.result.crawlBuckets {
+				ncs.result.crawlBuckets[i].peers = nil
+			}
+		}
+	}
+
 	cm.crawled[report.id] = ncs
+
+	if _, ok := cm.requeueOnFinish[report.id]; ok {
+		delete(cm.requeueOnFinish, report.id)
+		cm.toCrawl.enqueue(report.id)
+	}
 }
 
-func (cm *CrawlManager) dispatch(node peer.AddrInfo, id int) {
+// dispatch probes the given peer with the given worker and delivers the result
+// to results, unless abandoned is closed first.
+// The channels are passed explicitly, because they are replaced for every round
+// of a continuous crawl.
+func (cm *CrawlManager) dispatch(node peer.AddrInfo, id int, results chan<- nodeCrawlResult, abandoned <-chan struct{}) {
 	worker := cm.workers[id]
+	for _, o := range cm.observers {
+		o.OnCrawlStarted(node)
+	}
 	before := time.Now()
-	result, err := worker.crawlPeer(node)
+	result, dials, err := worker.crawlPeer(node)
 	after := time.Now()
 	if err != nil {
-		log.WithError(err).WithField("peer", node).Debug("unable to crawl node")
+		cm.logger.WithError(err).WithField("peer", node).Debug("unable to crawl node")
 	} else {
-		log.WithField("Result", result).Debug("crawled node")
+		cm.logger.WithField("Result", result).Debug("crawled node")
 	}
 
-	cm.resultChan <- nodeCrawlResult{
+	select {
+	case results <- nodeCrawlResult{
 		id:      node.ID,
+		addrs:   node.Addrs,
+		worker:  cm.workerNames[id],
 		node:    result,
 		startTs: before,
 		endTs:   after,
+		dials:   dials,
 		err:     err,
+	}:
+	case <-abandoned:
+		cm.logger.WithField("peer", node.ID).Debug("discarding result of abandoned crawl")
 	}
 	cm.tokenBucket <- id
 }
 
-func (cm *CrawlManager) handleNewNode(node peer.AddrInfo) {
-	state, ok := cm.crawled[node.ID]
-	if ok {
-		if state.err == nil && state.result.crawlDataError == nil {
-			// We've crawled the node successfully before, no need to try again.
-			return
-		}
+// handleNewNode processes a peer found in the routing table of source.
+func (cm *CrawlManager) handleNewNode(node peer.AddrInfo, source peer.ID) {
+	cm.toCrawl.dhtAddrs.add(node, source)
+
+	if cm.crawledEnough(node.ID) {
+		// We've crawled the node successfully before, no need to try again.
+		return
 	}
 
 	// We've either not crawled the node or failed before.
 	// The queue will decide whether we have new addresses and should retry.
+	_, known := cm.toCrawl.addrInfo[node.ID]
+	cm.toCrawl.policy.referenced(node.ID)
 	cm.toCrawl.push(node, false)
+	if !known {
+		for _, o := range cm.observers {
+			o.OnPeerDiscovered(node, source)
+		}
+	}
+}
+
+// dhtModes returns a classifier for the DHT mode of the peers crawled so far.
+func (cm *CrawlManager) dhtModes() dhtModeClassifier {
+	return dhtModeClassifier{
+		protocols: cm.config.CrawlerConfig.ProtocolStrings,
+		reports:   cm.toCrawl.dhtAddrs,
+	}
+}
+
+// createPartialReport creates the report of a crawl which ended early.
+func (cm *CrawlManager) createPartialReport(partial bool) CrawlOutput {
+	if cm.stream != nil {
+		cm.stream.partial = partial
+	}
+	report := cm.createReport()
+	report.partial = partial
+	return report
 }
 
 func (cm *CrawlManager) createReport() CrawlOutput {
-	numNodes := 0
-	numConnectable := 0
-	numCrawlable := 0
-
-	for _, state := range cm.crawled {
-		numNodes++
-		if state.err == nil {
-			numConnectable++
-			if state.result.crawlDataError == nil {
-				numCrawlable++
-			}
-		}
+	if cm.stream != nil {
+		cm.stream.resumedAt = cm.resumedAt
+		cm.stream.addrInfo = cm.toCrawl.addrInfo
+	}
+
+	report := CrawlOutput{
+		nodes:            cm.crawled,
+		addrInfo:         cm.toCrawl.addrInfo,
+		resumedAt:        cm.resumedAt,
+		partialCrawls:    cm.config.PartialCrawls,
+		peergraphBuckets: cm.config.PeergraphBuckets,
+		dhtModes:         cm.dhtModes(),
 	}
 
-	log.WithFields(log.Fields{
-		"number of nodes":   numNodes,
-		"connectable nodes": numConnectable,
-		"crawlable nodes":   numCrawlable,
+	stats := report.Stats()
+	cm.logger.WithFields(log.Fields{
+		"number of nodes":                  stats.NumNodes,
+		"connectable nodes":                stats.NumConnectable,
+		"crawlable nodes":                  stats.NumCrawlable,
+		"partial nodes":                    stats.NumPartial,
+		"abandoned nodes":                  stats.NumAbandoned,
+		"DHT servers":                      stats.NumDHTServers,
+		"DHT clients":                      stats.NumDHTClients,
+		"DHT clients in routing tables":    stats.NumDHTClientsInRoutingTables,
+		"nodes with compared addresses":    stats.NumAddrsCompared,
+		"nodes with identical addresses":   stats.NumAddrsIdentical,
+		"nodes with disjoint addresses":    stats.NumAddrsDisjoint,
+		"addresses only in routing tables": stats.NumDHTOnlyAddrs,
+		"nodes pinged":                     stats.NumRTTsByPing,
+		"nodes with FIND_NODE RTTs only":   stats.NumRTTsByFindNode,
 	}).Info("Crawl finished. Summary of results.")
+	for t, ts := range stats.Transports {
+		cm.logger.WithFields(log.Fields{
+			"transport":       t,
+			"nodes":           ts.NumPeers,
+			"reachable nodes": ts.NumReachable,
+		}).Info("Reachability by transport.")
+	}
 
-	return CrawlOutput{
-		nodes:    cm.crawled,
-		addrInfo: cm.toCrawl.addrInfo,
+	for _, o := range cm.observers {
+		o.OnCrawlComplete(stats)
 	}
+
+	return report
 }
@@ -0,0 +1,73 @@
+package crawling
+
+import (
+	"errors"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// DHTMode classifies a peer by whether it serves the DHT.
+// Peers in DHT client mode use the DHT, but do not answer requests, and should
+// therefore not appear in routing tables.
+type DHTMode string
+
+const (
+	// DHTModeServer means that the peer accepted a DHT stream, or that it
+	// advertises a DHT protocol via identify and opening the stream failed
+	// for another reason than the protocol not being supported.
+	DHTModeServer DHTMode = "server"
+
+	// DHTModeClient means that we could connect to the peer, but it refused
+	// DHT streams.
+	DHTModeClient DHTMode = "client"
+
+	// DHTModeUnknown means that we could not connect to the peer, or that
+	// opening a DHT stream failed, e.g., due to a timeout, and the peer does
+	// not advertise a DHT protocol.
+	DHTModeUnknown DHTMode = "unknown"
+)
+
+// dhtModeClassifier derives the DHT mode of peers from the results of probing
+// them and from the routing tables of other peers.
+// It also gives access to the addresses reported for peers in routing tables,
+// which are needed alongside the DHT mode wherever results are converted.
+type dhtModeClassifier struct {
+	// The DHT protocols we crawl with.
+	protocols []protocol.ID
+
+	// The peers found in the routing table of at least one other peer, with
+	// their reported addresses.
+	reports dhtAddrReports
+}
+
+// listed returns whether the given peer was found in the routing table of at
+// least one other peer.
+func (c dhtModeClassifier) listed(id peer.ID) bool {
+	return c.reports.listed(id)
+}
+
+// classify returns the DHT mode of a peer with the given status.
+func (c dhtModeClassifier) classify(status nodeCrawlStatus) DHTMode {
+	if status.err != nil {
+		return DHTModeUnknown
+	}
+	err := status.result.crawlDataError
+	switch {
+	case err == nil:
+		return DHTModeServer
+	case ErrorCodeOf(err) == ErrorCodeProtocolNotSupported:
+		return DHTModeClient
+	case errors.Is(err, errNoNeighbors):
+		// The stream was opened, but no FIND_NODE request was answered.
+		return DHTModeServer
+	}
+	for _, p := range status.result.info.SupportedProtocols {
+		for _, dp := range c.protocols {
+			if p == dp {
+				return DHTModeServer
+			}
+		}
+	}
+	return DHTModeUnknown
+}
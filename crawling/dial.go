@@ -0,0 +1,158 @@
+package crawling
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// DialMode decides how workers connect to peers.
+type DialMode string
+
+const (
+	// DialModeAll lets libp2p dial all addresses of a peer at once, as
+	// usual. Only the overall outcome is known.
+	// This is the default.
+	DialModeAll DialMode = "all"
+
+	// DialModePerAddress dials each address of a peer separately and
+	// concurrently and records the outcome of each, before connecting as
+	// usual if any of them succeeded.
+	// This costs a second connection per connectable peer, and is meant for
+	// research crawls.
+	DialModePerAddress DialMode = "per_address"
+)
+
+func (m DialMode) check() error {
+	switch m {
+	case "", DialModeAll, DialModePerAddress:
+		return nil
+	}
+	return fmt.Errorf("unknown dial mode %q", m)
+}
+
+// Transport identifies the transport of a multiaddress.
+type Transport string
+
+// Transports, as written to the output.
+const (
+	TransportTCP          Transport = "tcp"
+	TransportQUIC         Transport = "quic"
+	TransportQUICv1       Transport = "quic-v1"
+	TransportWebTransport Transport = "webtransport"
+	TransportWebSocket    Transport = "websocket"
+	TransportWebRTCDirect Transport = "webrtc-direct"
+	TransportCircuit      Transport = "p2p-circuit"
+	TransportUnknown      Transport = "unknown"
+)
+
+// transportOf returns the transport of the given address.
+// Protocols running on top of others, e.g., WebTransport on top of QUIC-v1,
+// take precedence.
+func transportOf(addr ma.Multiaddr) Transport {
+	has := func(code int) bool {
+		_, err := addr.ValueForProtocol(code)
+		return err == nil
+	}
+	switch {
+	case has(ma.P_CIRCUIT):
+		return TransportCircuit
+	case has(ma.P_WEBRTC_DIRECT):
+		return TransportWebRTCDirect
+	case has(ma.P_WEBTRANSPORT):
+		return TransportWebTransport
+	case has(ma.P_WS), has(ma.P_WSS):
+		return TransportWebSocket
+	case has(ma.P_QUIC_V1):
+		return TransportQUICv1
+	case has(ma.P_QUIC):
+		return TransportQUIC
+	case has(ma.P_TCP):
+		return TransportTCP
+	}
+	return TransportUnknown
+}
+
+// addrDial is the outcome of dialing a single address of a peer.
+type addrDial struct {
+	addr      ma.Multiaddr
+	transport Transport
+	startTs   time.Time
+	latency   time.Duration
+	err       error
+}
+
+// dialAddrs dials each of the peer's addresses separately and concurrently,
+// bypassing the swarm, and closes the resulting connections.
+// Addresses we have no transport for, including DNS addresses, fail with
+// ErrorCodeNoTransport.
+func (w *Libp2pWorker) dialAddrs(p peer.AddrInfo) []addrDial {
+	sw, ok := w.host.Network().(*swarm.Swarm)
+	if !ok {
+		panic(fmt.Sprintf("unexpected network %T", w.host.Network()))
+	}
+
+	res := make([]addrDial, len(p.Addrs))
+	var wg sync.WaitGroup
+	for i, addr := range p.Addrs {
+		// Transports expect addresses without the peer ID.
+		if rest, last := ma.SplitLast(addr); last != nil && last.Protocol().Code == ma.P_P2P {
+			addr = rest
+		}
+		res[i] = addrDial{
+			addr:      p.Addrs[i],
+			transport: transportOf(addr),
+			startTs:   time.Now(),
+		}
+
+		tpt := sw.TransportForDialing(addr)
+		if tpt == nil {
+			res[i].err = classifyError(swarm.ErrNoTransport, phaseDial)
+			continue
+		}
+		wg.Add(1)
+		go func(d *addrDial, addr ma.Multiaddr) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), w.config.ConnectTimeout)
+			defer cancel()
+			c, err := tpt.Dial(ctx, addr, p.ID)
+			d.latency = time.Since(d.startTs)
+			if err != nil {
+				d.err = classifyError(err, phaseDial)
+				return
+			}
+			_ = c.Close()
+		}(&res[i], addr)
+	}
+	wg.Wait()
+	return res
+}
+
+// dialsError combines the errors of per-address dials that all failed into a
+// single error, which is classified like an error from dialing all addresses
+// at once.
+func dialsError(p peer.ID, dials []addrDial) error {
+	if len(dials) == 0 {
+		return fmt.Errorf("dial: %w", classifyError(swarm.ErrNoAddresses, phaseDial))
+	}
+	err := &swarm.DialError{Peer: p}
+	for _, d := range dials {
+		err.DialErrors = append(err.DialErrors, swarm.TransportError{Address: d.addr, Cause: d.err})
+	}
+	return fmt.Errorf("dial: %w", classifyError(err, phaseDial))
+}
+
+// anyDialSucceeded returns whether any of the given dials succeeded.
+func anyDialSucceeded(dials []addrDial) bool {
+	for _, d := range dials {
+		if d.err == nil {
+			return true
+		}
+	}
+	return false
+}
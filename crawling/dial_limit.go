@@ -0,0 +1,194 @@
+package crawling
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// dialLimitRecheckInterval is how long a peer held back by a concurrency limit
+// waits before we check the limit again.
+const dialLimitRecheckInterval = 100 * time.Millisecond
+
+// DialLimitConfig limits how many peers behind the same IP address or subnet
+// are probed concurrently, and how quickly.
+// Subnets are /24 for IPv4 and /48 for IPv6.
+// A peer counts towards the limits of all public IP addresses it advertises.
+// Peers without public IP addresses are not limited.
+// Peers held back by the limits are deferred, not dropped.
+// Zero values disable the respective limit.
+type DialLimitConfig struct {
+	// The maximum number of concurrent probes per IP address and subnet.
+	MaxConcurrentPerIP     uint `yaml:"max_concurrent_per_ip"`
+	MaxConcurrentPerSubnet uint `yaml:"max_concurrent_per_subnet"`
+
+	// The maximum number of probes started per second, per IP address and
+	// subnet.
+	MaxRatePerIP     float64 `yaml:"max_rate_per_ip"`
+	MaxRatePerSubnet float64 `yaml:"max_rate_per_subnet"`
+}
+
+func (c *DialLimitConfig) check() error {
+	if c.MaxRatePerIP < 0 {
+		return fmt.Errorf("invalid max_rate_per_ip")
+	}
+	if c.MaxRatePerSubnet < 0 {
+		return fmt.Errorf("invalid max_rate_per_subnet")
+	}
+	return nil
+}
+
+// dialLimitKey identifies an IP address or subnet.
+type dialLimitKey struct {
+	subnet bool
+	addr   string
+}
+
+// dialLimitState is the state of a single IP address or subnet.
+type dialLimitState struct {
+	inFlight uint
+
+	// The earliest time at which the next probe may start.
+	nextStart time.Time
+}
+
+// dialLimiter implements DialLimitConfig.
+// It is not safe for concurrent use.
+type dialLimiter struct {
+	config DialLimitConfig
+	states map[dialLimitKey]*dialLimitState
+
+	// The keys held by peers in flight.
+	held map[peer.ID][]dialLimitKey
+}
+
+func newDialLimiter(config DialLimitConfig) *dialLimiter {
+	return &dialLimiter{
+		config: config,
+		states: make(map[dialLimitKey]*dialLimitState),
+		held:   make(map[peer.ID][]dialLimitKey),
+	}
+}
+
+// enabled returns whether any limit is configured.
+func (l *dialLimiter) enabled() bool {
+	c := l.config
+	return c.MaxConcurrentPerIP != 0 || c.MaxConcurrentPerSubnet != 0 || c.MaxRatePerIP != 0 || c.MaxRatePerSubnet != 0
+}
+
+// dialLimitKeys returns the IP addresses and subnets of the given addresses.
+// Addresses which are not public, e.g., loopback or private addresses, and
+// addresses without an IP, e.g., DNS addresses, are ignored, since they do
+// not identify the host the peer runs on.
+func dialLimitKeys(addrs []ma.Multiaddr) []dialLimitKey {
+	seen := make(map[dialLimitKey]struct{})
+	var keys []dialLimitKey
+	add := func(k dialLimitKey) {
+		if _, ok := seen[k]; !ok {
+			seen[k] = struct{}{}
+			keys = append(keys, k)
+		}
+	}
+
+	for _, addr := range addrs {
+		if !manet.IsPublicAddr(addr) {
+			continue
+		}
+		ip, err := manet.ToIP(addr)
+		if err != nil {
+			continue
+		}
+		add(dialLimitKey{addr: ip.String()})
+		if ip4 := ip.To4(); ip4 != nil {
+			add(dialLimitKey{subnet: true, addr: ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"})
+		} else {
+			add(dialLimitKey{subnet: true, addr: ip.Mask(net.CIDRMask(48, 128)).String() + "/48"})
+		}
+	}
+	return keys
+}
+
+// limits returns the concurrency and rate limits for the given key.
+func (l *dialLimiter) limits(k dialLimitKey) (uint, float64) {
+	if k.subnet {
+		return l.config.MaxConcurrentPerSubnet, l.config.MaxRatePerSubnet
+	}
+	return l.config.MaxConcurrentPerIP, l.config.MaxRatePerIP
+}
+
+// acquire attempts to reserve the limits of all IP addresses and subnets of
+// the given peer.
+// If that is not possible, it returns false and the time at which to try
+// again.
+func (l *dialLimiter) acquire(p peer.AddrInfo, now time.Time) (bool, time.Time) {
+	if !l.enabled() {
+		return true, time.Time{}
+	}
+
+	keys := dialLimitKeys(p.Addrs)
+	if len(keys) == 0 {
+		return true, time.Time{}
+	}
+
+	var retryAt time.Time
+	for _, k := range keys {
+		s, ok := l.states[k]
+		if !ok {
+			continue
+		}
+		maxConcurrent, _ := l.limits(k)
+		if maxConcurrent != 0 && s.inFlight >= maxConcurrent {
+			retryAt = laterOf(retryAt, now.Add(dialLimitRecheckInterval))
+		}
+		if now.Before(s.nextStart) {
+			retryAt = laterOf(retryAt, s.nextStart)
+		}
+	}
+	if !retryAt.IsZero() {
+		return false, retryAt
+	}
+
+	for _, k := range keys {
+		s, ok := l.states[k]
+		if !ok {
+			s = &dialLimitState{}
+			l.states[k] = s
+		}
+		s.inFlight++
+		if _, rate := l.limits(k); rate > 0 {
+			s.nextStart = now.Add(time.Duration(float64(time.Second) / rate))
+		}
+	}
+	l.held[p.ID] = keys
+	return true, time.Time{}
+}
+
+// release returns the limits reserved for the given peer.
+func (l *dialLimiter) release(id peer.ID, now time.Time) {
+	keys, ok := l.held[id]
+	if !ok {
+		return
+	}
+	delete(l.held, id)
+
+	for _, k := range keys {
+		s := l.states[k]
+		s.inFlight--
+		if s.inFlight == 0 && !now.Before(s.nextStart) {
+			// Nothing to remember.
+			delete(l.states, k)
+		}
+	}
+}
+
+// laterOf returns the later of the given times.
+func laterOf(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,308 @@
+package crawling
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/core/sec"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+	msmux "github.com/multiformats/go-multistream"
+)
+
+// ErrorCode is a stable identifier for a class of errors, suitable for
+// aggregate analysis of crawl results.
+type ErrorCode string
+
+// Error codes, as written to the output.
+const (
+	// ErrorCodeUnknown is used for errors we could not classify.
+	ErrorCodeUnknown ErrorCode = "unknown"
+
+	// ErrorCodeDialTimeout means that no connection could be established in
+	// time.
+	ErrorCodeDialTimeout ErrorCode = "dial_timeout"
+
+	// ErrorCodeDialBackoff means that libp2p refused to dial, because a
+	// previous dial failed recently.
+	ErrorCodeDialBackoff ErrorCode = "dial_backoff"
+
+	// ErrorCodeBlackHole means that libp2p refused to dial, because the
+	// transport appears to be unreachable from our vantage point.
+	ErrorCodeBlackHole ErrorCode = "black_hole"
+
+	// ErrorCodeConnectionRefused means that the remote host actively refused
+	// the connection.
+	ErrorCodeConnectionRefused ErrorCode = "connection_refused"
+
+	// ErrorCodeNoRoute means that the remote host or network is unreachable.
+	ErrorCodeNoRoute ErrorCode = "no_route"
+
+	// ErrorCodeConnectionReset means that the connection was reset or closed
+	// by the remote host.
+	ErrorCodeConnectionReset ErrorCode = "connection_reset"
+
+	// ErrorCodeNoAddresses means that the peer has no addresses we can dial.
+	ErrorCodeNoAddresses ErrorCode = "no_addresses"
+
+	// ErrorCodeNoTransport means that we do not support any transport of the
+	// peer's addresses.
+	ErrorCodeNoTransport ErrorCode = "no_transport"
+
+	// ErrorCodeSecurityHandshakeFailed means that a connection was
+	// established, but the security handshake failed.
+	ErrorCodeSecurityHandshakeFailed ErrorCode = "security_handshake_failed"
+
+	// ErrorCodeMuxerNegotiationFailed means that the security handshake
+	// succeeded, but no stream multiplexer could be negotiated.
+	ErrorCodeMuxerNegotiationFailed ErrorCode = "muxer_negotiation_failed"
+
+	// ErrorCodePeerIDMismatch means that the remote host has a different peer
+	// ID than expected.
+	ErrorCodePeerIDMismatch ErrorCode = "peer_id_mismatch"
+
+	// ErrorCodeProtocolNotSupported means that the peer does not support the
+	// protocol we asked for.
+	ErrorCodeProtocolNotSupported ErrorCode = "protocol_not_supported"
+
+	// ErrorCodeStreamTimeout means that a stream could not be opened in time.
+	ErrorCodeStreamTimeout ErrorCode = "stream_timeout"
+
+	// ErrorCodeStreamReset means that a stream was reset or closed by the
+	// remote host.
+	ErrorCodeStreamReset ErrorCode = "stream_reset"
+
+	// ErrorCodeIdentifyTimeout means that the peer did not answer an identify
+	// request in time.
+	ErrorCodeIdentifyTimeout ErrorCode = "identify_timeout"
+
+	// ErrorCodePingTimeout means that the peer did not answer a ping in
+	// time.
+	ErrorCodePingTimeout ErrorCode = "ping_timeout"
+
+	// ErrorCodeFindNodeTimeout means that a FIND_NODE request was not
+	// answered in time.
+	ErrorCodeFindNodeTimeout ErrorCode = "find_node_timeout"
+
+	// ErrorCodeInvalidResponse means that a response could not be parsed.
+	ErrorCodeInvalidResponse ErrorCode = "invalid_response"
+
+	// ErrorCodeTimeout is used for timeouts outside of the phases above, e.g.,
+	// in plugins.
+	ErrorCodeTimeout ErrorCode = "timeout"
+
+	// ErrorCodeCrawlDeadlineExceeded corresponds to ErrCrawlDeadlineExceeded.
+	ErrorCodeCrawlDeadlineExceeded ErrorCode = "crawl_deadline_exceeded"
+
+	// ErrorCodeCrawlInterrupted corresponds to ErrCrawlInterrupted.
+	ErrorCodeCrawlInterrupted ErrorCode = "crawl_interrupted"
+
+	// ErrorCodeWorkerFailed means that a remote worker could not be reached
+	// or returned an invalid response. This says nothing about the peer.
+	ErrorCodeWorkerFailed ErrorCode = "worker_failed"
+
+	// ErrorCodeNotRecorded means that a replayed crawl asked for something
+	// the recorded crawl did not, e.g., probed a peer more often.
+	ErrorCodeNotRecorded ErrorCode = "not_recorded"
+)
+
+// errorCodes lists all error codes, for validating the configuration.
+var errorCodes = map[ErrorCode]struct{}{
+	ErrorCodeUnknown:                 {},
+	ErrorCodeDialTimeout:             {},
+	ErrorCodeDialBackoff:             {},
+	ErrorCodeBlackHole:               {},
+	ErrorCodeConnectionRefused:       {},
+	ErrorCodeNoRoute:                 {},
+	ErrorCodeConnectionReset:         {},
+	ErrorCodeNoAddresses:             {},
+	ErrorCodeNoTransport:             {},
+	ErrorCodeSecurityHandshakeFailed: {},
+	ErrorCodeMuxerNegotiationFailed:  {},
+	ErrorCodePeerIDMismatch:          {},
+	ErrorCodeProtocolNotSupported:    {},
+	ErrorCodeStreamTimeout:           {},
+	ErrorCodeStreamReset:             {},
+	ErrorCodeIdentifyTimeout:         {},
+	ErrorCodePingTimeout:             {},
+	ErrorCodeFindNodeTimeout:         {},
+	ErrorCodeInvalidResponse:         {},
+	ErrorCodeTimeout:                 {},
+	ErrorCodeCrawlDeadlineExceeded:   {},
+	ErrorCodeCrawlInterrupted:        {},
+	ErrorCodeWorkerFailed:            {},
+	ErrorCodeNotRecorded:             {},
+}
+
+// errorPhase is the phase of probing a peer in which an error occurred.
+// Some errors, notably timeouts, are classified differently depending on it.
+type errorPhase int
+
+const (
+	phaseDial errorPhase = iota
+	phaseIdentify
+	phasePing
+	phaseStream
+	phaseFindNode
+	phasePlugin
+)
+
+// classifiedError attaches an ErrorCode to an error.
+// The message of the error is unchanged.
+type classifiedError struct {
+	code ErrorCode
+	err  error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// classifyError attaches an ErrorCode to the given error, which occurred in
+// the given phase.
+// Returns nil for nil errors, and errors that were already classified as they
+// are.
+func classifyError(err error, phase errorPhase) error {
+	if err == nil {
+		return nil
+	}
+	var ce *classifiedError
+	if errors.As(err, &ce) {
+		return err
+	}
+	return &classifiedError{code: errorCode(err, phase), err: err}
+}
+
+// ErrorCodeOf returns the ErrorCode of an error encountered during a crawl,
+// or an empty code for nil errors.
+func ErrorCodeOf(err error) ErrorCode {
+	if err == nil {
+		return ""
+	}
+	var ce *classifiedError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	return errorCode(err, phasePlugin)
+}
+
+// errorCodeToString returns the ErrorCode of the given error, or nil for nil
+// errors.
+func errorCodeToString(err error) *ErrorCode {
+	if err == nil {
+		return nil
+	}
+	code := ErrorCodeOf(err)
+	return &code
+}
+
+// dialErrorPriority orders the codes of errors for individual addresses.
+// If dialing multiple addresses failed, the code of the error that got
+// furthest is used for the whole dial.
+var dialErrorPriority = []ErrorCode{
+	ErrorCodePeerIDMismatch,
+	ErrorCodeMuxerNegotiationFailed,
+	ErrorCodeSecurityHandshakeFailed,
+	ErrorCodeConnectionReset,
+	ErrorCodeConnectionRefused,
+	ErrorCodeNoRoute,
+	ErrorCodeDialTimeout,
+}
+
+// errorCode classifies an error which occurred in the given phase.
+func errorCode(err error, phase errorPhase) ErrorCode {
+	var dialErr *swarm.DialError
+	if errors.As(err, &dialErr) && len(dialErr.DialErrors) != 0 {
+		codes := make(map[ErrorCode]struct{})
+		for _, te := range dialErr.DialErrors {
+			codes[errorCode(te.Cause, phaseDial)] = struct{}{}
+		}
+		for _, code := range dialErrorPriority {
+			if _, ok := codes[code]; ok {
+				return code
+			}
+		}
+		if len(codes) == 1 {
+			for code := range codes {
+				return code
+			}
+		}
+		if dialErr.Timeout() {
+			return ErrorCodeDialTimeout
+		}
+		return ErrorCodeUnknown
+	}
+
+	var mismatch sec.ErrPeerIDMismatch
+	var netErr net.Error
+	msg := err.Error()
+	switch {
+	case errors.Is(err, ErrCrawlDeadlineExceeded):
+		return ErrorCodeCrawlDeadlineExceeded
+	case errors.Is(err, ErrCrawlInterrupted):
+		return ErrorCodeCrawlInterrupted
+	case errors.As(err, &mismatch), strings.Contains(msg, "peer id mismatch"):
+		return ErrorCodePeerIDMismatch
+	case errors.Is(err, swarm.ErrNoAddresses), errors.Is(err, swarm.ErrNoGoodAddresses):
+		return ErrorCodeNoAddresses
+	case errors.Is(err, swarm.ErrNoTransport):
+		return ErrorCodeNoTransport
+	case errors.Is(err, swarm.ErrDialBackoff):
+		return ErrorCodeDialBackoff
+	case errors.Is(err, swarm.ErrDialRefusedBlackHole):
+		return ErrorCodeBlackHole
+	case errors.Is(err, msmux.ErrNotSupported[protocol.ID]{}), errors.Is(err, msmux.ErrNotSupported[string]{}):
+		if strings.Contains(msg, "failed to negotiate security protocol") {
+			return ErrorCodeSecurityHandshakeFailed
+		}
+		if strings.Contains(msg, "failed to negotiate stream multiplexer") {
+			return ErrorCodeMuxerNegotiationFailed
+		}
+		return ErrorCodeProtocolNotSupported
+	case strings.Contains(msg, "failed to negotiate security protocol"):
+		return ErrorCodeSecurityHandshakeFailed
+	case strings.Contains(msg, "failed to negotiate stream multiplexer"):
+		return ErrorCodeMuxerNegotiationFailed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorCodeConnectionRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return ErrorCodeNoRoute
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, os.ErrDeadlineExceeded),
+		errors.Is(err, swarm.ErrDialTimeout),
+		errors.As(err, &netErr) && netErr.Timeout():
+		switch phase {
+		case phaseDial:
+			return ErrorCodeDialTimeout
+		case phaseIdentify:
+			return ErrorCodeIdentifyTimeout
+		case phasePing:
+			return ErrorCodePingTimeout
+		case phaseStream:
+			return ErrorCodeStreamTimeout
+		case phaseFindNode:
+			return ErrorCodeFindNodeTimeout
+		default:
+			return ErrorCodeTimeout
+		}
+	case errors.Is(err, network.ErrReset),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		if phase == phaseDial {
+			return ErrorCodeConnectionReset
+		}
+		return ErrorCodeStreamReset
+	}
+	return ErrorCodeUnknown
+}
@@ -0,0 +1,156 @@
+package crawling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/core/record"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+	identifypb "github.com/libp2p/go-libp2p/p2p/protocol/identify/pb"
+	"github.com/libp2p/go-msgio/pbio"
+	ma "github.com/multiformats/go-multiaddr"
+	msmux "github.com/multiformats/go-multistream"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// identifyMaxMessageSize is the maximum size of a single part of an
+	// identify response, as accepted by go-libp2p.
+	identifyMaxMessageSize = 8 * 1024
+
+	// identifyMaxMessages is the maximum number of parts of an identify
+	// response, as accepted by go-libp2p.
+	identifyMaxMessages = 10
+)
+
+// identifyConn sends an identify request on the given connection and returns
+// the peer's response.
+// This is independent of the identify exchange libp2p runs on every new
+// connection, so that we get the full response and know if it failed.
+func identifyConn(ctx context.Context, c network.Conn) (PeerMetadata, error) {
+	s, err := c.NewStream(ctx)
+	if err != nil {
+		return PeerMetadata{}, fmt.Errorf("unable to open identify stream: %w", err)
+	}
+	defer func() { _ = s.Reset() }()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+	}
+	err = s.SetProtocol(identify.ID)
+	if err != nil {
+		return PeerMetadata{}, fmt.Errorf("unable to set identify protocol: %w", err)
+	}
+	err = msmux.SelectProtoOrFail(identify.ID, s)
+	if err != nil {
+		return PeerMetadata{}, fmt.Errorf("unable to negotiate identify protocol: %w", err)
+	}
+
+	// Large responses are split into multiple parts, which are merged.
+	var mes identifypb.Identify
+	r := pbio.NewDelimitedReader(s, identifyMaxMessageSize)
+	for i := 0; ; i++ {
+		if i == identifyMaxMessages {
+			return PeerMetadata{}, &classifiedError{code: ErrorCodeInvalidResponse, err: fmt.Errorf("identify response has too many parts")}
+		}
+		var part identifypb.Identify
+		err = r.ReadMsg(&part)
+		if errors.Is(err, io.EOF) && i != 0 {
+			break
+		}
+		if err != nil {
+			return PeerMetadata{}, fmt.Errorf("unable to read identify response: %w", err)
+		}
+		proto.Merge(&mes, &part)
+	}
+
+	return identifyResponseToMetadata(c, &mes), nil
+}
+
+// identifyResponseToMetadata extracts the metadata from an identify response
+// received on the given connection.
+// Unparseable addresses are skipped.
+func identifyResponseToMetadata(c network.Conn, mes *identifypb.Identify) PeerMetadata {
+	res := PeerMetadata{
+		AgentVersion:    mes.GetAgentVersion(),
+		ProtocolVersion: mes.GetProtocolVersion(),
+	}
+	for _, p := range mes.GetProtocols() {
+		res.SupportedProtocols = append(res.SupportedProtocols, protocol.ID(p))
+	}
+	for _, b := range mes.GetListenAddrs() {
+		addr, err := ma.NewMultiaddrBytes(b)
+		if err != nil {
+			continue
+		}
+		res.ListenAddrs = append(res.ListenAddrs, addr)
+	}
+	if addr, err := ma.NewMultiaddrBytes(mes.GetObservedAddr()); err == nil {
+		res.ObservedAddr = addr
+	}
+
+	// The key the connection was secured with is authenticated, unlike the
+	// one in the response.
+	if key := c.RemotePublicKey(); key != nil {
+		res.PublicKeyType = key.Type().String()
+	}
+
+	if len(mes.GetSignedPeerRecord()) != 0 {
+		res.SignedPeerRecord = true
+		res.SignedPeerRecordVerified = verifySignedPeerRecord(c.RemotePeer(), mes.GetSignedPeerRecord())
+	}
+	return res
+}
+
+// verifySignedPeerRecord returns whether the given envelope holds a peer record
+// of the given peer, signed by it.
+func verifySignedPeerRecord(p peer.ID, envelope []byte) bool {
+	env, rec, err := record.ConsumeEnvelope(envelope, peer.PeerRecordEnvelopeDomain)
+	if err != nil {
+		return false
+	}
+	signer, err := peer.IDFromPublicKey(env.PublicKey)
+	if err != nil || signer != p {
+		return false
+	}
+	pr, ok := rec.(*peer.PeerRecord)
+	return ok && pr.PeerID == p
+}
+
+// identify runs identifyConn with the configured timeout and number of
+// attempts.
+func (w *Libp2pWorker) identify(c network.Conn) (PeerMetadata, PhaseTiming, error) {
+	var timing PhaseTiming
+	var md PeerMetadata
+	var err error
+	startTs := time.Now()
+	for timing.Attempts < w.config.identifyAttempts() {
+		timing.Attempts++
+		ctx, cancel := context.WithTimeout(context.Background(), w.config.identifyTimeout())
+		md, err = identifyConn(ctx, c)
+		cancel()
+		if err == nil {
+			timing.Duration = time.Since(startTs)
+			return md, timing, nil
+		}
+		err = classifyError(err, phaseIdentify)
+		log.WithFields(log.Fields{
+			"err":    err,
+			"try":    timing.Attempts,
+			"peerID": c.RemotePeer(),
+		}).Debug("could not identify peer")
+		if ErrorCodeOf(err) == ErrorCodeProtocolNotSupported || c.IsClosed() {
+			// Trying again won't help.
+			break
+		}
+	}
+	timing.Duration = time.Since(startTs)
+	return PeerMetadata{}, timing, err
+}
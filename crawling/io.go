@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -16,36 +17,316 @@ import (
 // crawlOutputJSON is a helper struct to serialize the output of a crawl to
 // JSON.
 type crawlOutputJSON struct {
-	StartDate time.Time         `json:"start_timestamp"`
-	EndDate   time.Time         `json:"end_timestamp"`
-	Nodes     []crawledNodeJSON `json:"found_nodes"`
+	crawlOutputHeaderJSON
+	Nodes []crawledNodeJSON `json:"found_nodes"`
+}
+
+// crawlOutputHeaderJSON is a helper struct to serialize metadata about a crawl
+// to JSON.
+// The field Partial indicates whether the crawl was interrupted, the field
+// ResumedAt lists the times at which the crawl was resumed from a checkpoint.
+type crawlOutputHeaderJSON struct {
+	StartDate time.Time   `json:"start_timestamp"`
+	EndDate   time.Time   `json:"end_timestamp"`
+	Partial   bool        `json:"partial,omitempty"`
+	ResumedAt []time.Time `json:"resumed_at,omitempty"`
 }
 
 // crawledNodeJSON is a helper struct to serialize the result of probing a
 // single node to JSON.
-// The fields ConnectionError and Result are mutually exclusive.
+// The fields ConnectionError and Result describe the best attempt, see
+// NodeStatus, and are mutually exclusive.
 type crawledNodeJSON struct {
 	ID         peer.ID        `json:"id"`
 	MultiAddrs []ma.Multiaddr `json:"multiaddrs"`
+	Worker     string         `json:"worker"`
+
+	DHTMode        DHTMode `json:"dht_mode"`
+	InRoutingTable bool    `json:"in_routing_table"`
+
+	// The addresses reported for the node in routing tables.
+	DHTAddrs []reportedAddrJSON `json:"dht_addrs"`
+
+	ConnectionError     *string              `json:"connection_error"`
+	ConnectionErrorCode *ErrorCode           `json:"connection_error_code"`
+	Result              *crawledNodeDataJSON `json:"result"`
+
+	Attempts []crawlAttemptJSON `json:"attempts"`
+}
 
-	ConnectionError *string              `json:"connection_error"`
-	Result          *crawledNodeDataJSON `json:"result"`
+// crawlAttemptJSON is a helper struct to serialize a summary of a single
+// attempt to probe a node to JSON.
+// The field Error holds the connection error or, if we could connect, the
+// crawl error. The field CrawlState is nil if we could not connect.
+// The field Dials is only set if addresses were dialed separately.
+// Neighbors and buckets are only serialized for the best attempt, to keep the
+// output from growing with every retry.
+type crawlAttemptJSON struct {
+	StartTs      time.Time      `json:"start_ts"`
+	EndTs        time.Time      `json:"end_ts"`
+	MultiAddrs   []ma.Multiaddr `json:"multiaddrs"`
+	Worker       string         `json:"worker"`
+	Dials        []addrDialJSON `json:"dials"`
+	Error        *string        `json:"error"`
+	ErrorCode    *ErrorCode     `json:"error_code"`
+	Retryable    bool           `json:"retryable"`
+	CrawlState   *CrawlState    `json:"crawl_state"`
+	NumNeighbors int            `json:"num_neighbors"`
 }
 
 // crawledNodeDataJSON is a helper struct to serialize information about a
 // single node to JSON.
-// The field CrawlError indicates whether an error occurred during crawling.
+// The field CrawlError indicates whether crawling failed. If it succeeded only
+// partially, CrawlPartialError holds the last error instead.
+// If IdentifyError is set, the identify fields hold what libp2p stored anyway.
 type crawledNodeDataJSON struct {
+	ConnectedAddr ma.Multiaddr `json:"connected_addr"`
+
 	AgentVersion       string        `json:"agent_version"`
 	SupportedProtocols []protocol.ID `json:"supported_protocols"`
 
-	CrawlBeginTs time.Time `json:"crawl_begin_ts"`
-	CrawlEndTs   time.Time `json:"crawl_end_ts"`
-	CrawlError   *string   `json:"crawl_error"`
+	ProtocolVersion          string         `json:"protocol_version"`
+	ListenAddrs              []ma.Multiaddr `json:"listen_addrs"`
+	ObservedAddr             ma.Multiaddr   `json:"observed_addr"`
+	PublicKeyType            string         `json:"public_key_type"`
+	SignedPeerRecord         bool           `json:"signed_peer_record"`
+	SignedPeerRecordVerified bool           `json:"signed_peer_record_verified"`
+	IdentifyError            *string        `json:"identify_error"`
+	IdentifyErrorCode        *ErrorCode     `json:"identify_error_code"`
+
+	Timings timingsJSON `json:"timings"`
+
+	RTT           *rttJSON   `json:"rtt"`
+	PingError     *string    `json:"ping_error"`
+	PingErrorCode *ErrorCode `json:"ping_error_code"`
+
+	CrawlBeginTs   time.Time  `json:"crawl_begin_ts"`
+	CrawlEndTs     time.Time  `json:"crawl_end_ts"`
+	CrawlError     *string    `json:"crawl_error"`
+	CrawlErrorCode *ErrorCode `json:"crawl_error_code"`
+
+	CrawlState            CrawlState `json:"crawl_state"`
+	CrawlPartialError     *string    `json:"crawl_partial_error"`
+	CrawlPartialErrorCode *ErrorCode `json:"crawl_partial_error_code"`
+	CrawlFailedBuckets    []int      `json:"crawl_failed_buckets"`
+
+	// The buckets queried, in order of their common prefix length.
+	Buckets []bucketResultJSON `json:"buckets"`
 
 	PluginData map[string]pluginResultJSON `json:"plugin_data"`
 }
 
+// bucketResultJSON is a helper struct to serialize a bucketResult to JSON.
+// It is also used for checkpoints and by remote workers.
+type bucketResultJSON struct {
+	CPL        uint8         `json:"cpl"`
+	Target     []byte        `json:"target"`
+	StartTs    time.Time     `json:"start_ts"`
+	EndTs      time.Time     `json:"end_ts"`
+	Attempts   uint          `json:"attempts"`
+	Error      *string       `json:"error"`
+	ErrorCode  *ErrorCode    `json:"error_code"`
+	Peers      []peer.ID     `json:"peers"`
+	Duplicates int           `json:"duplicates"`
+	Latency    time.Duration `json:"latency"`
+}
+
+// reportedAddrJSON is a helper struct to serialize a reportedAddr to JSON.
+// It is also used for checkpoints.
+type reportedAddrJSON struct {
+	Addr       ma.Multiaddr `json:"addr"`
+	ReportedBy []peer.ID    `json:"reported_by"`
+}
+
+// reportedAddrsToJSON converts the addresses reported for a peer to JSON,
+// returning nil if the peer was not reported.
+func (r *peerAddrReports) reportedAddrsToJSON() []reportedAddrJSON {
+	if r == nil {
+		return nil
+	}
+	res := make([]reportedAddrJSON, 0, len(r.addrs))
+	for _, ra := range r.addrs {
+		res = append(res, reportedAddrJSON{
+			Addr:       ra.addr,
+			ReportedBy: ra.reporters,
+		})
+	}
+	return res
+}
+
+// bucketResultsToJSON converts bucket results to JSON, keeping nil as nil.
+func bucketResultsToJSON(buckets []bucketResult) []bucketResultJSON {
+	if buckets == nil {
+		return nil
+	}
+	res := make([]bucketResultJSON, 0, len(buckets))
+	for _, b := range buckets {
+		res = append(res, bucketResultJSON{
+			CPL:        b.cpl,
+			Target:     b.target,
+			StartTs:    b.startTs,
+			EndTs:      b.endTs,
+			Attempts:   b.attempts,
+			Error:      errorToString(b.err),
+			ErrorCode:  errorCodeToString(b.err),
+			Peers:      b.peers,
+			Duplicates: b.duplicates,
+			Latency:    b.latency,
+		})
+	}
+	return res
+}
+
+// timingsJSON is a helper struct to serialize Timings to JSON.
+type timingsJSON struct {
+	Connect  phaseTimingJSON `json:"connect"`
+	Dial     time.Duration   `json:"dial"`
+	Muxer    time.Duration   `json:"muxer"`
+	Identify phaseTimingJSON `json:"identify"`
+	Stream   phaseTimingJSON `json:"stream"`
+}
+
+// phaseTimingJSON is a helper struct to serialize a PhaseTiming to JSON.
+type phaseTimingJSON struct {
+	Duration time.Duration `json:"duration"`
+	Attempts uint          `json:"attempts"`
+}
+
+func timingsToJSON(t Timings) timingsJSON {
+	return timingsJSON{
+		Connect:  phaseTimingJSON(t.Connect),
+		Dial:     t.Dial,
+		Muxer:    t.Muxer,
+		Identify: phaseTimingJSON(t.Identify),
+		Stream:   phaseTimingJSON(t.Stream),
+	}
+}
+
+// rttJSON is a helper struct to serialize an RTT to JSON.
+type rttJSON struct {
+	Source    RTTSource       `json:"source"`
+	Samples   []time.Duration `json:"samples"`
+	Min       time.Duration   `json:"min"`
+	Median    time.Duration   `json:"median"`
+	Max       time.Duration   `json:"max"`
+	Transport Transport       `json:"transport"`
+}
+
+// rttToJSON converts an RTT to JSON, returning nil if there are no samples.
+func rttToJSON(r RTT) *rttJSON {
+	if len(r.Samples) == 0 {
+		return nil
+	}
+	return &rttJSON{
+		Source:    r.Source,
+		Samples:   r.Samples,
+		Min:       r.Min,
+		Median:    r.Median,
+		Max:       r.Max,
+		Transport: r.Transport,
+	}
+}
+
+// addrDialJSON is a helper struct to serialize an addrDial to JSON.
+// It is also used for checkpoints, recordings and by remote workers.
+type addrDialJSON struct {
+	Addr      ma.Multiaddr  `json:"addr"`
+	Transport Transport     `json:"transport"`
+	StartTs   time.Time     `json:"start_ts"`
+	Latency   time.Duration `json:"latency"`
+	Error     *string       `json:"error"`
+	ErrorCode *ErrorCode    `json:"error_code"`
+}
+
+// addrDialsToJSON converts per-address dials to JSON, keeping nil as nil.
+func addrDialsToJSON(dials []addrDial) []addrDialJSON {
+	if dials == nil {
+		return nil
+	}
+	res := make([]addrDialJSON, 0, len(dials))
+	for _, d := range dials {
+		res = append(res, addrDialJSON{
+			Addr:      d.addr,
+			Transport: d.transport,
+			StartTs:   d.startTs,
+			Latency:   d.latency,
+			Error:     errorToString(d.err),
+			ErrorCode: errorCodeToString(d.err),
+		})
+	}
+	return res
+}
+
+// addrDialsFromJSON restores per-address dials converted with
+// addrDialsToJSON.
+func addrDialsFromJSON(dials []addrDialJSON) []addrDial {
+	if dials == nil {
+		return nil
+	}
+	res := make([]addrDial, 0, len(dials))
+	for _, d := range dials {
+		res = append(res, addrDial{
+			addr:      d.Addr,
+			transport: d.Transport,
+			startTs:   d.StartTs,
+			latency:   d.Latency,
+			err:       errorFromString(d.Error, d.ErrorCode),
+		})
+	}
+	return res
+}
+
+// crawlState returns how far crawling the neighbors of the node got.
+func (r *nodeInformation) crawlState() CrawlState {
+	switch {
+	case r.crawlDataError != nil:
+		return CrawlStateFailed
+	case r.crawlDataPartialError != nil:
+		return CrawlStatePartial
+	default:
+		return CrawlStateComplete
+	}
+}
+
+// neighborBuckets returns, for each neighbor, the common prefix length of the
+// bucket it was first returned for, formatted for the peer graph.
+// Neighbors are missing if buckets were not recorded, e.g., for results
+// restored from older checkpoints.
+func (r *nodeInformation) neighborBuckets() map[peer.ID]string {
+	res := make(map[peer.ID]string)
+	for _, b := range r.crawlBuckets {
+		for _, p := range b.peers {
+			if _, ok := res[p]; !ok {
+				res[p] = strconv.Itoa(int(b.cpl))
+			}
+		}
+	}
+	return res
+}
+
+// bucketResultsFromJSON restores bucket results converted with
+// bucketResultsToJSON.
+func bucketResultsFromJSON(buckets []bucketResultJSON) []bucketResult {
+	if buckets == nil {
+		return nil
+	}
+	res := make([]bucketResult, 0, len(buckets))
+	for _, b := range buckets {
+		res = append(res, bucketResult{
+			cpl:        b.CPL,
+			target:     b.Target,
+			startTs:    b.StartTs,
+			endTs:      b.EndTs,
+			attempts:   b.Attempts,
+			err:        errorFromString(b.Error, b.ErrorCode),
+			peers:      b.Peers,
+			duplicates: b.Duplicates,
+			latency:    b.Latency,
+		})
+	}
+	return res
+}
+
 // pluginResultJSON is a helper struct to serialize information about executing
 // a plugin on a connectable node to JSON.
 // The fields Error and Result are mutually exclusive.
@@ -53,29 +334,77 @@ type pluginResultJSON struct {
 	BeginTimestamp time.Time   `json:"begin_timestamp"`
 	EndTimestamp   time.Time   `json:"end_timestamp"`
 	Error          *string     `json:"error"`
+	ErrorCode      *ErrorCode  `json:"error_code"`
 	Result         interface{} `json:"result"`
 }
 
-func (r nodeCrawlStatus) toCrawledNode(addrBook map[peer.ID][]ma.Multiaddr, id peer.ID) crawledNodeJSON {
+func (r nodeCrawlStatus) toCrawledNode(addrBook map[peer.ID][]ma.Multiaddr, id peer.ID, dht dhtModeClassifier) crawledNodeJSON {
 	addr := addrBook[id]
 	res := crawledNodeJSON{
-		ID:         id,
-		MultiAddrs: addr,
+		ID:             id,
+		MultiAddrs:     addr,
+		Worker:         r.worker,
+		DHTMode:        dht.classify(r),
+		InRoutingTable: dht.listed(id),
+		DHTAddrs:       dht.reports[id].reportedAddrsToJSON(),
+	}
+	for _, a := range r.attempts {
+		attempt := crawlAttemptJSON{
+			StartTs:      a.startTs,
+			EndTs:        a.endTs,
+			MultiAddrs:   a.addrs,
+			Worker:       a.worker,
+			Dials:        addrDialsToJSON(a.dials),
+			Error:        errorToString(a.failure()),
+			ErrorCode:    errorCodeToString(a.failure()),
+			Retryable:    a.retryable,
+			NumNeighbors: a.numNeighbors,
+		}
+		if a.result != nil {
+			state := a.result.crawlState()
+			attempt.CrawlState = &state
+		}
+		res.Attempts = append(res.Attempts, attempt)
 	}
 	if r.err != nil {
 		tmp := r.err.Error()
 		res.ConnectionError = &tmp
+		res.ConnectionErrorCode = errorCodeToString(r.err)
 		return res
 	}
+	res.Result = r.result.toCrawledNodeData()
 
-	res.Result = new(crawledNodeDataJSON)
-	res.Result.AgentVersion = r.result.info.AgentVersion
-	res.Result.SupportedProtocols = r.result.info.SupportedProtocols
+	return res
+}
+
+// toCrawledNodeData converts possibly nil information to a possibly nil
+// crawledNodeDataJSON.
+func (r *nodeInformation) toCrawledNodeData() *crawledNodeDataJSON {
+	if r == nil {
+		return nil
+	}
 
-	if len(r.result.pluginResults) != 0 {
-		res.Result.PluginData = make(map[string]pluginResultJSON)
+	res := new(crawledNodeDataJSON)
+	res.ConnectedAddr = r.connectedAddr
+	res.AgentVersion = r.info.AgentVersion
+	res.SupportedProtocols = r.info.SupportedProtocols
+	res.ProtocolVersion = r.info.ProtocolVersion
+	res.ListenAddrs = r.info.ListenAddrs
+	res.ObservedAddr = r.info.ObservedAddr
+	res.PublicKeyType = r.info.PublicKeyType
+	res.SignedPeerRecord = r.info.SignedPeerRecord
+	res.SignedPeerRecordVerified = r.info.SignedPeerRecordVerified
+	res.IdentifyError = errorToString(r.identifyError)
+	res.IdentifyErrorCode = errorCodeToString(r.identifyError)
+	res.Timings = timingsToJSON(r.timings)
+	res.RTT = rttToJSON(r.rtt())
+	res.PingError = errorToString(r.pingError)
+	res.PingErrorCode = errorCodeToString(r.pingError)
 
-		for pn, pd := range r.result.pluginResults {
+	if len(r.pluginResults) != 0 {
+		res.PluginData = make(map[string]pluginResultJSON)
+
+		for pn, pd := range r.pluginResults {
 			tmp := pluginResultJSON{
 				BeginTimestamp: pd.beginTimestamp,
 				EndTimestamp:   pd.endTimestamp,
@@ -85,16 +414,27 @@ func (r nodeCrawlStatus) toCrawledNode(addrBook map[peer.ID][]ma.Multiaddr, id p
 			if pd.err != nil {
 				tmp2 := pd.err.Error()
 				tmp.Error = &tmp2
+				tmp.ErrorCode = errorCodeToString(pd.err)
 			}
-			res.Result.PluginData[pn] = tmp
+			res.PluginData[pn] = tmp
 		}
 	}
 
-	res.Result.CrawlBeginTs = r.result.crawlDataBeginTs
-	res.Result.CrawlEndTs = r.result.crawlDataEndTs
-	if r.result.crawlDataError != nil {
-		tmp := r.result.crawlDataError.Error()
-		res.Result.CrawlError = &tmp
+	res.CrawlBeginTs = r.crawlDataBeginTs
+	res.CrawlEndTs = r.crawlDataEndTs
+	res.Buckets = bucketResultsToJSON(r.crawlBuckets)
+	res.CrawlState = r.crawlState()
+	res.CrawlPartialError = errorToString(r.crawlDataPartialError)
+	res.CrawlPartialErrorCode = errorCodeToString(r.crawlDataPartialError)
+	for _, b := range r.crawlBuckets {
+		if b.err != nil {
+			res.CrawlFailedBuckets = append(res.CrawlFailedBuckets, int(b.cpl))
+		}
+	}
+	if r.crawlDataError != nil {
+		tmp := r.crawlDataError.Error()
+		res.CrawlError = &tmp
+		res.CrawlErrorCode = errorCodeToString(r.crawlDataError)
 		return res
 	}
 
@@ -106,9 +446,17 @@ func (r nodeCrawlStatus) toCrawledNode(addrBook map[peer.ID][]ma.Multiaddr, id p
 func (report *CrawlOutput) WriteMetadata(startTs time.Time, endTs time.Time, path string) error {
 	var nodes []crawledNodeJSON
 	for id, node := range report.nodes {
-		nodes = append(nodes, node.toCrawledNode(report.addrInfo, id))
+		nodes = append(nodes, node.toCrawledNode(report.addrInfo, id, report.dhtModes))
+	}
+	crawlOutput := crawlOutputJSON{
+		crawlOutputHeaderJSON: crawlOutputHeaderJSON{
+			StartDate: startTs,
+			EndDate:   endTs,
+			Partial:   report.partial,
+			ResumedAt: report.resumedAt,
+		},
+		Nodes: nodes,
 	}
-	crawlOutput := crawlOutputJSON{StartDate: startTs, EndDate: endTs, Nodes: nodes}
 
 	// Open output file.
 	vf, err := os.Create(path)
@@ -134,7 +482,7 @@ func (report *CrawlOutput) WritePeergraph(path string) error {
 
 	w := csv.NewWriter(f)
 
-	err = w.Write([]string{"source", "target", "target_crawlable", "source_crawl_timestamp"})
+	err = w.Write(peergraphRow(report.peergraphBuckets, "source", "target", "target_crawlable", "source_crawl_timestamp", "bucket"))
 	if err != nil {
 		return fmt.Errorf("unable to write output: %w", err)
 	}
@@ -142,10 +490,14 @@ func (report *CrawlOutput) WritePeergraph(path string) error {
 		if node.err != nil || node.result.crawlDataError != nil {
 			continue
 		}
+		if report.partialCrawls.ExcludeFromPeergraph && node.result.crawlState() == CrawlStatePartial {
+			continue
+		}
 		ts := node.result.crawlDataEndTs.Format(time.RFC3339)
+		buckets := node.result.neighborBuckets()
 		for _, neighbour := range node.result.crawlNeighbors {
-			crawlable := fmt.Sprintf("%t", report.nodes[neighbour].err == nil && report.nodes[neighbour].result.crawlDataError == nil)
-			err = w.Write([]string{id.String(), neighbour.String(), crawlable, ts})
+			crawlable := fmt.Sprintf("%t", report.crawlable(neighbour))
+			err = w.Write(peergraphRow(report.peergraphBuckets, id.String(), neighbour.String(), crawlable, ts, buckets[neighbour]))
 			if err != nil {
 				return fmt.Errorf("unable to write output: %w", err)
 			}
@@ -160,6 +512,22 @@ func (report *CrawlOutput) WritePeergraph(path string) error {
 	return f.Close()
 }
 
+// crawlable returns whether the given peer was crawled, possibly partially.
+// Peers which were never probed, e.g., because the crawl ended early, are not.
+func (report *CrawlOutput) crawlable(id peer.ID) bool {
+	node, ok := report.nodes[id]
+	return ok && node.err == nil && node.result != nil && node.result.crawlDataError == nil
+}
+
+// peergraphRow returns a row of the peer graph, which includes the bucket
+// column only if withBucket is set.
+func peergraphRow(withBucket bool, source string, target string, crawlable string, ts string, bucket string) []string {
+	if withBucket {
+		return []string{source, target, crawlable, ts, bucket}
+	}
+	return []string{source, target, crawlable, ts}
+}
+
 // RestoreNodeCache restores a list of peer addresses from a file.
 func RestoreNodeCache(path string) ([]peer.AddrInfo, error) {
 	nodedata, err := os.ReadFile(path)
@@ -185,6 +553,9 @@ func (report *CrawlOutput) SaveNodeCache(cacheFile string) error {
 		if node.err != nil || node.result.crawlDataError != nil {
 			continue
 		}
+		if report.partialCrawls.ExcludeFromNodeCache && node.result.crawlState() == CrawlStatePartial {
+			continue
+		}
 		nodesSave = append(nodesSave, peer.AddrInfo{
 			ID:    id,
 			Addrs: report.addrInfo[id],
@@ -25,6 +25,41 @@ type WorkerConfig struct {
 	ConnectTimeout     time.Duration `yaml:"connect_timeout"`
 	ConnectionAttempts uint          `yaml:"connection_attempts"`
 	UserAgent          string        `yaml:"user_agent"`
+
+	// The timeout and number of attempts for identifying a peer once
+	// connected. Default to ConnectTimeout and ConnectionAttempts.
+	IdentifyTimeout  time.Duration `yaml:"identify_timeout"`
+	IdentifyAttempts uint          `yaml:"identify_attempts"`
+
+	// How to connect to peers. Defaults to DialModeAll.
+	DialMode DialMode `yaml:"dial_mode"`
+
+	// The number of pings to measure the round-trip time to connectable
+	// peers with, and the timeout for each. If PingSamples is zero, peers
+	// are not pinged. PingTimeout defaults to ConnectTimeout.
+	PingSamples uint          `yaml:"ping_samples"`
+	PingTimeout time.Duration `yaml:"ping_timeout"`
+}
+
+func (c WorkerConfig) identifyTimeout() time.Duration {
+	if c.IdentifyTimeout == 0 {
+		return c.ConnectTimeout
+	}
+	return c.IdentifyTimeout
+}
+
+func (c WorkerConfig) identifyAttempts() uint {
+	if c.IdentifyAttempts == 0 {
+		return c.ConnectionAttempts
+	}
+	return c.IdentifyAttempts
+}
+
+func (c WorkerConfig) pingTimeout() time.Duration {
+	if c.PingTimeout == 0 {
+		return c.ConnectTimeout
+	}
+	return c.PingTimeout
 }
 
 func (c WorkerConfig) check() error {
@@ -37,6 +72,16 @@ func (c WorkerConfig) check() error {
 	if len(c.UserAgent) == 0 {
 		return fmt.Errorf("missing user agent")
 	}
+	if c.IdentifyTimeout < 0 {
+		return fmt.Errorf("invalid identify timeout")
+	}
+	if c.PingTimeout < 0 {
+		return fmt.Errorf("invalid ping timeout")
+	}
+	err := c.DialMode.check()
+	if err != nil {
+		return fmt.Errorf("invalid dial mode: %w", err)
+	}
 	return nil
 }
 
@@ -48,6 +93,12 @@ type Libp2pWorker struct {
 	plugins     []Plugin
 	closed      chan struct{}
 	closingLock sync.Mutex
+
+	// Times the handshakes of connections to the peers being probed.
+	handshakes *handshakeTimer
+
+	// If set, everything observed from peers is recorded.
+	recorder *recorder
 }
 
 // NewLibp2pWorker creates a new libp2p worker.
@@ -61,8 +112,9 @@ func NewLibp2pWorker(config WorkerConfig, pluginConfigs []PluginConfig, preimage
 	}
 
 	w := &Libp2pWorker{
-		config: config,
-		closed: make(chan struct{}),
+		config:     config,
+		closed:     make(chan struct{}),
+		handshakes: newHandshakeTimer(),
 	}
 
 	rm := network.NullResourceManager{}
@@ -74,6 +126,7 @@ func NewLibp2pWorker(config WorkerConfig, pluginConfigs []PluginConfig, preimage
 		libp2p.SwarmOpts(swarm.WithReadOnlyBlackHoleDetector()),
 		libp2p.UDPBlackHoleSuccessCounter(nil),
 		libp2p.IPv6BlackHoleSuccessCounter(nil),
+		libp2p.ConnectionGater(w.handshakes),
 	}
 	h, err := libp2p.New(opts...)
 	if err != nil {
@@ -108,7 +161,7 @@ func (w *Libp2pWorker) connect(p peer.AddrInfo) (network.Conn, error) {
 	// for the identity protocol to finish.
 	err := w.host.Connect(ctx, p)
 	if err != nil {
-		return nil, fmt.Errorf("dial: %w", err)
+		return nil, fmt.Errorf("dial: %w", classifyError(err, phaseDial))
 	}
 
 	// What we really want is the connection itself, though.
@@ -117,40 +170,91 @@ func (w *Libp2pWorker) connect(p peer.AddrInfo) (network.Conn, error) {
 	defer cancel()
 	c, err := w.host.Network().DialPeer(ctx, p.ID)
 	if err != nil {
-		return nil, fmt.Errorf("dial: %w", err)
+		return nil, fmt.Errorf("dial: %w", classifyError(err, phaseDial))
 	}
 
 	return c, nil
 }
 
 // CrawlPeer implements worker.
-func (w *Libp2pWorker) crawlPeer(remote peer.AddrInfo) (*rawNodeInformation, error) {
+func (w *Libp2pWorker) crawlPeer(remote peer.AddrInfo) (*rawNodeInformation, []addrDial, error) {
 	// Sleep to de-sync
 	time.Sleep(time.Duration(rand.Intn(DesyncMillisMax)) * time.Millisecond)
 
+	rec := w.recorder.newProbe(remote)
+	defer w.recorder.finish(rec)
+
+	var dials []addrDial
+	if w.config.DialMode == DialModePerAddress {
+		// Dial each address on its own first, in as many rounds as we
+		// would try to connect, and only connect as usual if any of them
+		// worked.
+		for i := uint(0); i < w.config.ConnectionAttempts; i++ {
+			round := w.dialAddrs(remote)
+			dials = append(dials, round...)
+			if anyDialSucceeded(round) {
+				break
+			}
+		}
+		rec.setDials(dials)
+		if !anyDialSucceeded(dials) {
+			err := dialsError(remote.ID, dials)
+			rec.setDialError(err)
+			return nil, dials, err
+		}
+	}
+
 	// Connect to peer
+	var timings Timings
 	var conn network.Conn
 	var err error
-	for i := uint(0); i < w.config.ConnectionAttempts; i++ {
+	connectStartTs := time.Now()
+	defer w.handshakes.unwatch(remote.ID)
+	for timings.Connect.Attempts < w.config.ConnectionAttempts {
+		timings.Connect.Attempts++
+		attemptStartTs := time.Now()
+		w.handshakes.watch(remote.ID)
 		conn, err = w.connect(remote)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"err":      err,
-				"try":      i + 1,
+				"try":      timings.Connect.Attempts,
 				"destAddr": remote,
 			}).Debug("could not connect")
-		} else {
-			break
+			continue
+		}
+		if securedTs, upgradedTs, ok := w.handshakes.unwatch(remote.ID); ok {
+			timings.Dial = securedTs.Sub(attemptStartTs)
+			timings.Muxer = upgradedTs.Sub(securedTs)
 		}
+		break
 	}
+	timings.Connect.Duration = time.Since(connectStartTs)
 	if err != nil {
-		return nil, err
+		rec.setDialError(err)
+		return nil, dials, err
 	}
 	defer func() { _ = conn.Close() }()
 
+	// Identify the peer explicitly, because the identify exchange libp2p runs
+	// on new connections may not have finished, and does not give us the
+	// whole response.
+	infos, identifyTiming, identifyErr := w.identify(conn)
+	timings.Identify = identifyTiming
+
+	// Measure the round-trip time before crawling, so that FIND_NODE
+	// requests do not interfere.
+	pingSamples, pingErr := w.ping(conn)
+	if identifyErr != nil {
+		log.WithError(identifyErr).WithField("peer", remote.ID).Debug("unable to identify peer")
+		// Fall back to whatever libp2p's identify exchange stored.
+		infos = w.peerstoreMetadata(remote.ID)
+	}
+
 	// Execute crawler "plugin"
 	crawlBeginTs := time.Now()
-	crawlData, crawlErr := w.crawler.HandlePeer(remote)
+	crawlData, streamTiming, crawlErr := w.crawler.HandlePeer(remote, rec)
+	timings.Stream = streamTiming
 	crawlEndTs := time.Now()
 	if crawlErr != nil {
 		log.WithError(crawlErr).WithField("peer", remote.ID).Debug("unable to crawl peer")
@@ -165,40 +269,57 @@ func (w *Libp2pWorker) crawlPeer(remote peer.AddrInfo) (*rawNodeInformation, err
 			log.WithError(err).WithField("remote", remote.ID).WithField("plugin", p.Name()).Debug("plugin failed")
 		}
 		pluginResults[p.Name()] = pluginResult{
-			err:    err,
+			err:    classifyError(err, phasePlugin),
 			result: res,
 		}
 	}
 
-	// TODO figure out a way to actually _force_ identify a connection, potentially with retries.
-	// We could call (*idService).identifyConn(c network.Conn), which we need to get via reflection or so first...
-	// This seems fine for now. If the connection works, it's identified
-	// (confirmed from testing).
+	node := &rawNodeInformation{
+		connectedAddr: conn.RemoteMultiaddr(),
+		info:          infos,
+		identifyErr:   identifyErr,
+		timings:       timings,
+		pingSamples:   pingSamples,
+		pingErr:       pingErr,
+		crawlData: crawlResult{
+			beginTimestamp: crawlBeginTs,
+			endTimestamp:   crawlEndTs,
+			err:            crawlErr,
+			result:         crawlData,
+		},
+		pluginResults: pluginResults,
+	}
+	err = rec.setNode(node)
+	if err != nil {
+		log.WithError(err).WithField("peer", remote.ID).Error("unable to record probe")
+	}
+	return node, dials, nil
+}
 
-	var infos peerMetadata
-	agentVersion, err := w.host.Peerstore().Get(remote.ID, "AgentVersion")
+// peerstoreMetadata returns the metadata of the given peer stored in the
+// peerstore by libp2p's own identify exchange, if any.
+func (w *Libp2pWorker) peerstoreMetadata(p peer.ID) PeerMetadata {
+	var infos PeerMetadata
+	agentVersion, err := w.host.Peerstore().Get(p, "AgentVersion")
 	if err != nil {
-		log.WithError(err).WithField("peer", remote.ID).Debug("unable to get agent version")
+		log.WithError(err).WithField("peer", p).Debug("unable to get agent version")
 	} else {
 		infos.AgentVersion = agentVersion.(string)
 	}
-	protocols, err := w.host.Peerstore().GetProtocols(remote.ID)
+	protocolVersion, err := w.host.Peerstore().Get(p, "ProtocolVersion")
+	if err == nil {
+		infos.ProtocolVersion = protocolVersion.(string)
+	}
+	protocols, err := w.host.Peerstore().GetProtocols(p)
 	if err != nil {
-		log.WithError(err).WithField("peer", remote.ID).Warn("unable to get supported protocols")
+		log.WithError(err).WithField("peer", p).Warn("unable to get supported protocols")
 	} else {
 		infos.SupportedProtocols = protocols
 	}
-
-	return &rawNodeInformation{
-		info: infos,
-		crawlData: crawlResult{
-			beginTimestamp: crawlBeginTs,
-			endTimestamp:   crawlEndTs,
-			err:            crawlErr,
-			result:         crawlData,
-		},
-		pluginResults: pluginResults,
-	}, nil
+	if key := w.host.Peerstore().PubKey(p); key != nil {
+		infos.PublicKeyType = key.Type().String()
+	}
+	return infos
 }
 
 // Stop stops the Libp2pWorker.
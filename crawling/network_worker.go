@@ -0,0 +1,130 @@
+package crawling
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	log "github.com/sirupsen/logrus"
+)
+
+// A Network answers the requests of workers in place of a libp2p host, e.g.,
+// to test the crawler against a simulated network with known properties.
+// See NewCrawlManagerWithNetwork.
+// Implementations must support concurrent calls. Errors are classified like
+// those of libp2p, so returning, e.g., context.DeadlineExceeded or
+// syscall.ECONNREFUSED leads to the corresponding ErrorCode.
+type Network interface {
+	// Connect connects to the given peer and returns its metadata, as it
+	// would be obtained via identify, and the address it connected to.
+	Connect(ctx context.Context, p peer.AddrInfo) (PeerMetadata, ma.Multiaddr, error)
+
+	// FindNode sends a FIND_NODE request to the given peer, for a key that
+	// has a common prefix of length cpl with the peer's ID, and returns the
+	// peers in the response.
+	FindNode(ctx context.Context, p peer.ID, cpl uint8) ([]peer.AddrInfo, error)
+}
+
+// networkWorker implements worker on top of a Network.
+// Neighbors are obtained with the same logic as by a Libp2pWorker, but no
+// plugins are executed.
+type networkWorker struct {
+	network  Network
+	config   WorkerConfig
+	crawler  *crawler
+	recorder *recorder
+}
+
+// newNetworkWorker creates a worker which probes peers via the given network.
+// Of the WorkerConfig, only ConnectTimeout and ConnectionAttempts are used.
+func newNetworkWorker(network Network, config WorkerConfig, crawlerConfig CrawlerConfig) (*networkWorker, error) {
+	c, err := newCrawler(nil, crawlerConfig, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create crawler plugin: %w", err)
+	}
+	return &networkWorker{
+		network: network,
+		config:  config,
+		crawler: c,
+	}, nil
+}
+
+// connect connects to the given peer, making up to ConnectionAttempts
+// attempts of up to ConnectTimeout each.
+func (w *networkWorker) connect(p peer.AddrInfo) (PeerMetadata, ma.Multiaddr, PhaseTiming, error) {
+	var timing PhaseTiming
+	var md PeerMetadata
+	var addr ma.Multiaddr
+	var err error
+	startTs := time.Now()
+	for timing.Attempts == 0 || timing.Attempts < w.config.ConnectionAttempts {
+		timing.Attempts++
+		ctx := context.Background()
+		cancel := func() {}
+		if w.config.ConnectTimeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, w.config.ConnectTimeout)
+		}
+		md, addr, err = w.network.Connect(ctx, p)
+		cancel()
+		if err == nil {
+			timing.Duration = time.Since(startTs)
+			return md, addr, timing, nil
+		}
+		log.WithFields(log.Fields{
+			"err":      err,
+			"try":      timing.Attempts,
+			"destAddr": p,
+		}).Debug("could not connect")
+	}
+	timing.Duration = time.Since(startTs)
+	return md, nil, timing, fmt.Errorf("dial: %w", classifyError(err, phaseDial))
+}
+
+// crawlPeer implements worker.
+// Addresses are never dialed separately.
+func (w *networkWorker) crawlPeer(p peer.AddrInfo) (*rawNodeInformation, []addrDial, error) {
+	rec := w.recorder.newProbe(p)
+	defer w.recorder.finish(rec)
+
+	md, addr, connectTiming, err := w.connect(p)
+	if err != nil {
+		rec.setDialError(err)
+		return nil, nil, err
+	}
+
+	crawlBeginTs := time.Now()
+	crawlData, crawlErr := w.crawler.crawlNeighbors(p.ID, func(ctx context.Context, cpl uint8) ([]byte, []peer.AddrInfo, error) {
+		peers, err := w.network.FindNode(ctx, p.ID, cpl)
+		rec.addFindNode(cpl, nil, peers, err)
+		return nil, peers, err
+	})
+	crawlEndTs := time.Now()
+	if crawlErr != nil {
+		log.WithError(crawlErr).WithField("peer", p.ID).Debug("unable to crawl peer")
+	}
+
+	node := &rawNodeInformation{
+		connectedAddr: addr,
+		info:          md,
+		timings:       Timings{Connect: connectTiming},
+		crawlData: crawlResult{
+			beginTimestamp: crawlBeginTs,
+			endTimestamp:   crawlEndTs,
+			err:            crawlErr,
+			result:         crawlData,
+		},
+	}
+	err = rec.setNode(node)
+	if err != nil {
+		log.WithError(err).WithField("peer", p.ID).Error("unable to record probe")
+	}
+	return node, nil, nil
+}
+
+// stop implements worker.
+// The network is left as it is.
+func (w *networkWorker) stop() error {
+	return w.crawler.Shutdown()
+}
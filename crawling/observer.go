@@ -0,0 +1,139 @@
+package crawling
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	observerDriversM sync.RWMutex
+	observerDrivers  = make(map[string]ObserverDriver)
+
+	// ErrObserverDoesNotExist is the error returned by NewObserver when an
+	// observer with that name does not exist.
+	ErrObserverDoesNotExist = fmt.Errorf("observer driver with that name does not exist")
+)
+
+// An Observer is notified about events during a crawl, e.g., to display
+// progress live or to trigger follow-up measurements.
+//
+// Methods may be called concurrently. They are called from the crawl loop and
+// should return quickly, since they delay the crawl otherwise.
+type Observer interface {
+	// OnPeerDiscovered is called when we learn about a peer for the first
+	// time. source is the peer whose routing table contained the new peer,
+	// or empty if the peer was added with AddPeersToCrawl.
+	OnPeerDiscovered(p peer.AddrInfo, source peer.ID)
+
+	// OnCrawlStarted is called before a peer is probed.
+	// This may be called multiple times for a peer, e.g., if new addresses
+	// were learned after a failed attempt.
+	OnCrawlStarted(p peer.AddrInfo)
+
+	// OnCrawlFinished is called after a peer was probed.
+	OnCrawlFinished(result NodeStatus)
+
+	// OnCrawlComplete is called once the crawl, or a round of a continuous
+	// crawl, is finished.
+	OnCrawlComplete(summary CrawlStats)
+
+	// Shutdown ensures clean shutdown of this observer.
+	Shutdown() error
+}
+
+// NopObserver implements Observer with methods that do nothing.
+// It can be embedded to implement only some of the methods.
+type NopObserver struct{}
+
+// OnPeerDiscovered implements Observer.
+func (NopObserver) OnPeerDiscovered(peer.AddrInfo, peer.ID) {}
+
+// OnCrawlStarted implements Observer.
+func (NopObserver) OnCrawlStarted(peer.AddrInfo) {}
+
+// OnCrawlFinished implements Observer.
+func (NopObserver) OnCrawlFinished(NodeStatus) {}
+
+// OnCrawlComplete implements Observer.
+func (NopObserver) OnCrawlComplete(CrawlStats) {}
+
+// Shutdown implements Observer.
+func (NopObserver) Shutdown() error { return nil }
+
+// An ObserverDriver is a provider for an observer implementation.
+type ObserverDriver interface {
+	// NewObserver creates a new observer.
+	// It is provided with a yaml-encoded representation of its configuration.
+	NewObserver(cfg []byte) (Observer, error)
+}
+
+// RegisterObserver makes an ObserverDriver available by the provided name.
+//
+// If called twice with the same name, the name is blank, or if the provided
+// ObserverDriver is nil, this function panics.
+func RegisterObserver(name string, d ObserverDriver) {
+	if name == "" {
+		panic("observer: could not register an ObserverDriver with an empty name")
+	}
+	if d == nil {
+		panic("observer: could not register a nil ObserverDriver")
+	}
+
+	observerDriversM.Lock()
+	defer observerDriversM.Unlock()
+
+	if _, dup := observerDrivers[name]; dup {
+		panic("observer: RegisterObserver called twice for " + name)
+	}
+
+	observerDrivers[name] = d
+}
+
+// NewObserver attempts to initialize a new observer instance from the list of
+// registered observers.
+//
+// If an observer does not exist, returns ErrObserverDoesNotExist.
+func NewObserver(name string, optionBytes []byte) (Observer, error) {
+	observerDriversM.RLock()
+	defer observerDriversM.RUnlock()
+
+	d, ok := observerDrivers[name]
+	if !ok {
+		return nil, ErrObserverDoesNotExist
+	}
+
+	return d.NewObserver(optionBytes)
+}
+
+// ObserverConfig is the generic configuration format used for all registered
+// observers.
+type ObserverConfig struct {
+	Name    string                 `yaml:"name"`
+	Options map[string]interface{} `yaml:"options"`
+}
+
+// ObserversFromObserverConfigs is a utility function to initialize observers
+// in bulk.
+func ObserversFromObserverConfigs(cfgs []ObserverConfig) ([]Observer, error) {
+	var observers []Observer
+
+	for _, cfg := range cfgs {
+		// Marshal the options back into bytes.
+		optionBytes, err := yaml.Marshal(cfg.Options)
+		if err != nil {
+			return nil, err
+		}
+
+		o, err := NewObserver(cfg.Name, optionBytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create observer %s: %w", cfg.Name, err)
+		}
+
+		observers = append(observers, o)
+	}
+
+	return observers, nil
+}
@@ -0,0 +1,557 @@
+package crawling
+
+import (
+	"iter"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// NodeStatus is what we know about a peer after probing it.
+// If the peer was probed multiple times, the status is taken from the best
+// attempt: attempts that crawled the peer are preferred over attempts that
+// only connected, which are preferred over attempts that failed to connect.
+// Among equally good attempts, the last one is used.
+// The fields ConnectionError and Info are mutually exclusive.
+type NodeStatus struct {
+	ID peer.ID
+
+	// When probing the peer was started and finished.
+	StartTimestamp time.Time
+	EndTimestamp   time.Time
+
+	// The name of the worker which probed the peer. This is empty if the
+	// crawl ended before the peer could be probed.
+	Worker string
+
+	// The error encountered while connecting to the peer, if any.
+	// Use ErrorCodeOf to classify it.
+	ConnectionError error
+
+	// Information obtained from the peer, if it was connectable.
+	Info *NodeInfo
+
+	// Whether the peer serves the DHT, as far as we can tell.
+	DHTMode DHTMode
+
+	// Whether the peer was found in the routing table of at least one other
+	// peer. DHT clients should not be.
+	// If results are streamed, only routing tables crawled before the peer
+	// are taken into account.
+	InRoutingTable bool
+
+	// The addresses reported for the peer in routing tables, in order of
+	// their first report. The same applies to streamed results.
+	DHTAddrs []ReportedAddr
+
+	// All attempts to probe the peer, oldest first.
+	Attempts []Attempt
+}
+
+// ReportedAddr is an address of a peer found in routing tables.
+type ReportedAddr struct {
+	Addr ma.Multiaddr
+
+	// The peers in whose routing table the peer was found with this
+	// address.
+	ReportedBy []peer.ID
+}
+
+// Attempt is the outcome of a single attempt to probe a peer.
+// The fields ConnectionError and Info are mutually exclusive.
+type Attempt struct {
+	StartTimestamp time.Time
+	EndTimestamp   time.Time
+
+	// The addresses we knew for the peer when the attempt was started.
+	Addrs []ma.Multiaddr
+
+	// The name of the worker which probed the peer, if any.
+	Worker string
+
+	// The outcome of dialing each address, if they were dialed separately.
+	// See DialModePerAddress.
+	Dials []AddrDial
+
+	// The error encountered while connecting to the peer, if any.
+	ConnectionError error
+
+	// Information obtained from the peer, if it was connectable.
+	Info *NodeInfo
+
+	// Whether the attempt failed with a transient error, i.e., may be
+	// retried.
+	Retryable bool
+}
+
+// AddrDial is the outcome of dialing a single address of a peer.
+type AddrDial struct {
+	Addr      ma.Multiaddr
+	Transport Transport
+	Timestamp time.Time
+
+	// The time it took to establish a connection or to fail.
+	Latency time.Duration
+
+	// The error encountered, if any.
+	Error error
+}
+
+// Failure returns the connection error or, if we could connect, the crawl
+// error of the attempt.
+func (a Attempt) Failure() error {
+	if a.ConnectionError != nil {
+		return a.ConnectionError
+	}
+	return a.Info.CrawlError
+}
+
+// Connectable returns whether we were able to connect to the peer.
+func (s NodeStatus) Connectable() bool {
+	return s.ConnectionError == nil
+}
+
+// Crawlable returns whether we were able to connect to the peer and obtain
+// its neighbors, possibly only partially.
+func (s NodeStatus) Crawlable() bool {
+	return s.ConnectionError == nil && s.Info.CrawlError == nil
+}
+
+// CrawlState describes how far crawling the neighbors of a connectable peer
+// got.
+type CrawlState string
+
+const (
+	// CrawlStateComplete means that all buckets were crawled.
+	CrawlStateComplete CrawlState = "complete"
+
+	// CrawlStatePartial means that some buckets were crawled, but others
+	// failed, so some neighbors may be missing.
+	CrawlStatePartial CrawlState = "partial"
+
+	// CrawlStateFailed means that no neighbors could be obtained.
+	CrawlStateFailed CrawlState = "failed"
+)
+
+// NodeInfo holds the information obtained from a connectable peer.
+// The fields CrawlError and Neighbors are mutually exclusive.
+type NodeInfo struct {
+	Metadata      PeerMetadata
+	PluginResults map[string]PluginResult
+
+	// The address we connected to the peer on, if known.
+	ConnectedAddr ma.Multiaddr
+
+	// The error encountered while identifying the peer, if any.
+	IdentifyError error
+
+	// How long the phases of probing the peer took.
+	Timings Timings
+
+	// The round-trip times to the peer, and the error encountered while
+	// pinging it, if any.
+	RTT       RTT
+	PingError error
+
+	// When crawling the peer's neighbors was started and finished.
+	CrawlBeginTimestamp time.Time
+	CrawlEndTimestamp   time.Time
+
+	// The error encountered while crawling the peer's neighbors, if any.
+	CrawlError error
+
+	// The last error encountered while crawling the peer's neighbors, if
+	// some buckets could not be crawled, although others could.
+	PartialCrawlError error
+
+	// The peers found in the routing table of the peer.
+	Neighbors []peer.ID
+
+	// The buckets of the peer's routing table we queried, in order of their
+	// common prefix length.
+	Buckets []BucketResult
+}
+
+// CrawlState returns how far crawling the peer's neighbors got.
+func (i *NodeInfo) CrawlState() CrawlState {
+	switch {
+	case i.CrawlError != nil:
+		return CrawlStateFailed
+	case i.PartialCrawlError != nil:
+		return CrawlStatePartial
+	default:
+		return CrawlStateComplete
+	}
+}
+
+// FailedBuckets returns the common prefix lengths of the buckets that could
+// not be crawled.
+func (i *NodeInfo) FailedBuckets() []uint8 {
+	var res []uint8
+	for _, b := range i.Buckets {
+		if b.Error != nil {
+			res = append(res, b.CPL)
+		}
+	}
+	return res
+}
+
+// BucketResult describes querying a single bucket of a peer's routing table.
+type BucketResult struct {
+	// The common prefix length of the bucket.
+	CPL uint8
+
+	BeginTimestamp time.Time
+	EndTimestamp   time.Time
+
+	// The number of FIND_NODE requests sent for the bucket.
+	Attempts uint
+
+	// The error of the last request, if all of them failed.
+	Error error
+
+	// The key the FIND_NODE requests were sent for, if known.
+	Target []byte
+
+	// The peers in the response, in order.
+	Peers []peer.ID
+
+	// The number of peers in the response that were already returned for a
+	// bucket with a smaller common prefix length, or earlier in the same
+	// response.
+	Duplicates int
+
+	// The time it took to receive the response.
+	Latency time.Duration
+}
+
+// PeerMetadata holds metadata about a peer, obtained through the identify
+// protocol.
+// If identify failed, this holds what libp2p's own identify exchange on the
+// connection stored, if anything, and NodeInfo.IdentifyError is set.
+type PeerMetadata struct {
+	AgentVersion    string
+	ProtocolVersion string
+
+	SupportedProtocols []protocol.ID
+
+	// The addresses the peer listens on, and our address as observed by the
+	// peer, as announced by it.
+	// An empty multiaddr cannot be decoded from JSON, so it is omitted.
+	ListenAddrs  []ma.Multiaddr
+	ObservedAddr ma.Multiaddr `json:",omitempty"`
+
+	// The type of the peer's public key, e.g., "Ed25519".
+	PublicKeyType string
+
+	// Whether the peer sent a signed peer record, and whether it was a valid
+	// record of the peer, signed by it.
+	SignedPeerRecord         bool
+	SignedPeerRecordVerified bool
+}
+
+// PluginResult is the result of executing a plugin on a peer.
+// The fields Error and Result are mutually exclusive.
+type PluginResult struct {
+	BeginTimestamp time.Time
+	EndTimestamp   time.Time
+	Error          error
+
+	// The value returned by the plugin. For results restored from a
+	// checkpoint, this is a json.RawMessage.
+	Result interface{}
+}
+
+// CrawlStats summarizes the results of a crawl.
+type CrawlStats struct {
+	// The number of peers we learned about, including those never probed.
+	NumDiscovered int
+
+	// The number of peers we probed.
+	NumNodes int
+
+	// The number of peers we could connect to.
+	NumConnectable int
+
+	// The number of peers we could connect to and obtain neighbors from.
+	NumCrawlable int
+
+	// The number of crawlable peers of which only some buckets could be
+	// crawled.
+	NumPartial int
+
+	// The number of peers that were still being probed when the crawl
+	// ended early.
+	NumAbandoned int
+
+	// The number of peers in DHT server and client mode. Peers whose mode is
+	// unknown are not counted.
+	NumDHTServers int
+	NumDHTClients int
+
+	// The number of peers in DHT client mode which were found in the routing
+	// table of another peer.
+	NumDHTClientsInRoutingTables int
+
+	// The number of connectable peers which announced listen addresses via
+	// identify and were found in routing tables with addresses, and of
+	// those, how many had exactly the same or no common addresses in both.
+	NumAddrsCompared  int
+	NumAddrsIdentical int
+	NumAddrsDisjoint  int
+
+	// Summed over the compared peers, the number of addresses in both, only
+	// in routing tables, which are likely stale, and only announced via
+	// identify.
+	NumCommonAddrs     int
+	NumDHTOnlyAddrs    int
+	NumListenOnlyAddrs int
+
+	// The number of connectable peers whose round-trip time was measured by
+	// pinging them, and from FIND_NODE requests, respectively.
+	NumRTTsByPing     int
+	NumRTTsByFindNode int
+
+	// Reachability per transport, if addresses were dialed separately.
+	// Transports no address was dialed with are missing.
+	Transports map[Transport]TransportStats
+}
+
+// TransportStats summarizes the per-address dials of a single transport.
+type TransportStats struct {
+	// The number of peers with at least one address of the transport which
+	// was dialed.
+	NumPeers int
+
+	// The number of those peers which could be dialed via at least one of
+	// these addresses, in any attempt.
+	NumReachable int
+}
+
+func (r nodeCrawlStatus) toNodeStatus(id peer.ID, dht dhtModeClassifier) NodeStatus {
+	res := NodeStatus{
+		ID:              id,
+		StartTimestamp:  r.startTs,
+		EndTimestamp:    r.endTs,
+		Worker:          r.worker,
+		ConnectionError: r.err,
+		DHTMode:         dht.classify(r),
+		InRoutingTable:  dht.listed(id),
+	}
+	if reports, ok := dht.reports[id]; ok {
+		for _, ra := range reports.addrs {
+			res.DHTAddrs = append(res.DHTAddrs, ReportedAddr{Addr: ra.addr, ReportedBy: ra.reporters})
+		}
+	}
+	for _, a := range r.attempts {
+		var dials []AddrDial
+		for _, d := range a.dials {
+			dials = append(dials, AddrDial{
+				Addr:      d.addr,
+				Transport: d.transport,
+				Timestamp: d.startTs,
+				Latency:   d.latency,
+				Error:     d.err,
+			})
+		}
+		res.Attempts = append(res.Attempts, Attempt{
+			StartTimestamp:  a.startTs,
+			EndTimestamp:    a.endTs,
+			Addrs:           a.addrs,
+			Worker:          a.worker,
+			Dials:           dials,
+			ConnectionError: a.err,
+			Info:            a.result.toNodeInfo(),
+			Retryable:       a.retryable,
+		})
+	}
+	res.Info = r.result.toNodeInfo()
+
+	return res
+}
+
+// toNodeInfo converts possibly nil information to a possibly nil NodeInfo.
+func (r *nodeInformation) toNodeInfo() *NodeInfo {
+	if r == nil {
+		return nil
+	}
+
+	res := &NodeInfo{
+		Metadata:            r.info,
+		ConnectedAddr:       r.connectedAddr,
+		IdentifyError:       r.identifyError,
+		Timings:             r.timings,
+		RTT:                 r.rtt(),
+		PingError:           r.pingError,
+		CrawlBeginTimestamp: r.crawlDataBeginTs,
+		CrawlEndTimestamp:   r.crawlDataEndTs,
+		CrawlError:          r.crawlDataError,
+		PartialCrawlError:   r.crawlDataPartialError,
+		Neighbors:           r.crawlNeighbors,
+	}
+	for _, b := range r.crawlBuckets {
+		res.Buckets = append(res.Buckets, BucketResult{
+			CPL:            b.cpl,
+			BeginTimestamp: b.startTs,
+			EndTimestamp:   b.endTs,
+			Attempts:       b.attempts,
+			Error:          b.err,
+			Target:         b.target,
+			Peers:          b.peers,
+			Duplicates:     b.duplicates,
+			Latency:        b.latency,
+		})
+	}
+	if len(r.pluginResults) != 0 {
+		res.PluginResults = make(map[string]PluginResult, len(r.pluginResults))
+		for pn, pd := range r.pluginResults {
+			res.PluginResults[pn] = PluginResult{
+				BeginTimestamp: pd.beginTimestamp,
+				EndTimestamp:   pd.endTimestamp,
+				Error:          pd.err,
+				Result:         pd.result,
+			}
+		}
+	}
+
+	return res
+}
+
+// Partial returns whether the crawl was interrupted before it was finished.
+func (report *CrawlOutput) Partial() bool {
+	return report.partial
+}
+
+// ResumedAt returns the times at which the crawl was resumed from a
+// checkpoint.
+func (report *CrawlOutput) ResumedAt() []time.Time {
+	return report.resumedAt
+}
+
+// Nodes iterates over all peers we probed.
+// The order of iteration is unspecified.
+func (report *CrawlOutput) Nodes() iter.Seq2[peer.ID, NodeStatus] {
+	return func(yield func(peer.ID, NodeStatus) bool) {
+		for id, status := range report.nodes {
+			if !yield(id, status.toNodeStatus(id, report.dhtModes)) {
+				return
+			}
+		}
+	}
+}
+
+// Node returns the status of the given peer, if we probed it.
+func (report *CrawlOutput) Node(id peer.ID) (NodeStatus, bool) {
+	status, ok := report.nodes[id]
+	if !ok {
+		return NodeStatus{}, false
+	}
+	return status.toNodeStatus(id, report.dhtModes), true
+}
+
+// Neighbors returns the peers found in the routing table of the given peer.
+// This is nil if the peer was not crawlable, or if results were streamed to
+// disk with a StreamingWriter.
+func (report *CrawlOutput) Neighbors(id peer.ID) []peer.ID {
+	status, ok := report.nodes[id]
+	if !ok || status.result == nil {
+		return nil
+	}
+	return status.result.crawlNeighbors
+}
+
+// Addrs returns all addresses we know for the given peer.
+// This includes peers that we learned about, but did not probe.
+func (report *CrawlOutput) Addrs(id peer.ID) []ma.Multiaddr {
+	return report.addrInfo[id]
+}
+
+// Stats summarizes the results of the crawl.
+func (report *CrawlOutput) Stats() CrawlStats {
+	stats := computeStats(report.nodes, report.dhtModes)
+	stats.NumDiscovered = len(report.addrInfo)
+	return stats
+}
+
+// addAddrOverlap adds the comparison of a peer's listen addresses with the
+// addresses reported for it in routing tables, if both are known.
+func (stats *CrawlStats) addAddrOverlap(listen []ma.Multiaddr, dht []ma.Multiaddr) {
+	if len(listen) == 0 || len(dht) == 0 {
+		return
+	}
+	o := compareAddrs(listen, dht)
+	stats.NumAddrsCompared++
+	if o.onlyDHT == 0 && o.onlyListen == 0 {
+		stats.NumAddrsIdentical++
+	}
+	if o.common == 0 {
+		stats.NumAddrsDisjoint++
+	}
+	stats.NumCommonAddrs += o.common
+	stats.NumDHTOnlyAddrs += o.onlyDHT
+	stats.NumListenOnlyAddrs += o.onlyListen
+}
+
+// addDials adds the per-address dials of all attempts to probe a peer.
+func (stats *CrawlStats) addDials(attempts []crawlAttempt) {
+	reachable := make(map[Transport]bool)
+	for _, a := range attempts {
+		for _, d := range a.dials {
+			reachable[d.transport] = reachable[d.transport] || d.err == nil
+		}
+	}
+	if len(reachable) == 0 {
+		return
+	}
+	if stats.Transports == nil {
+		stats.Transports = make(map[Transport]TransportStats)
+	}
+	for t, ok := range reachable {
+		ts := stats.Transports[t]
+		ts.NumPeers++
+		if ok {
+			ts.NumReachable++
+		}
+		stats.Transports[t] = ts
+	}
+}
+
+// computeStats summarizes the given crawl results.
+// NumDiscovered is not set.
+func computeStats(nodes map[peer.ID]nodeCrawlStatus, dht dhtModeClassifier) CrawlStats {
+	var stats CrawlStats
+	for id, state := range nodes {
+		stats.NumNodes++
+		stats.addDials(state.attempts)
+		switch dht.classify(state) {
+		case DHTModeServer:
+			stats.NumDHTServers++
+		case DHTModeClient:
+			stats.NumDHTClients++
+			if dht.listed(id) {
+				stats.NumDHTClientsInRoutingTables++
+			}
+		}
+		if state.err == nil {
+			stats.NumConnectable++
+			stats.addAddrOverlap(state.result.info.ListenAddrs, dht.reports.addrs(id))
+			switch state.result.rtt().Source {
+			case RTTSourcePing:
+				stats.NumRTTsByPing++
+			case RTTSourceFindNode:
+				stats.NumRTTsByFindNode++
+			}
+			if state.result.crawlDataError == nil {
+				stats.NumCrawlable++
+			}
+			if state.result.crawlState() == CrawlStatePartial {
+				stats.NumPartial++
+			}
+		} else if isAbandoned(state.err) {
+			stats.NumAbandoned++
+		}
+	}
+	return stats
+}
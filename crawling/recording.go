@@ -0,0 +1,371 @@
+package crawling
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/zstd"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	log "github.com/sirupsen/logrus"
+)
+
+// recordingVersion is incremented whenever the recording format changes in an
+// incompatible way.
+const recordingVersion = 1
+
+// A recording is a log of everything the local workers observed from peers
+// during a crawl, which can be replayed to reproduce the crawl offline.
+// It consists of a recordingHeaderJSON, followed by one probeRecordJSON per
+// probe, in the order in which the probes finished, as NDJSON.
+
+// recordingHeaderJSON is the first line of a recording.
+type recordingHeaderJSON struct {
+	Version int       `json:"version"`
+	StartTs time.Time `json:"start_ts"`
+
+	// The peers queued when the crawl was started, in order.
+	Peers []peer.AddrInfo `json:"peers"`
+}
+
+// probeRecordJSON records a single probe of a peer.
+// Dials lists the per-address dials, if the worker dialed each address on its
+// own. If dialing the peer failed, only they, DialError and DialErrorCode are
+// set.
+// Otherwise, StreamError and StreamErrorCode are set if no stream could be
+// opened, and FindNode lists all FIND_NODE requests and their responses.
+// Node holds the remaining results, notably identify data and plugin results.
+type probeRecordJSON struct {
+	Peer    peer.ID        `json:"peer"`
+	Addrs   []ma.Multiaddr `json:"addrs"`
+	StartTs time.Time      `json:"start_ts"`
+	EndTs   time.Time      `json:"end_ts"`
+
+	Dials         []addrDialJSON `json:"dials,omitempty"`
+	DialError     *string        `json:"dial_error,omitempty"`
+	DialErrorCode *ErrorCode     `json:"dial_error_code,omitempty"`
+
+	StreamError     *string    `json:"stream_error,omitempty"`
+	StreamErrorCode *ErrorCode `json:"stream_error_code,omitempty"`
+
+	FindNode []findNodeRecordJSON    `json:"find_node,omitempty"`
+	Node     *rawNodeInformationJSON `json:"node,omitempty"`
+
+	// Guards FindNode, which is appended to concurrently if buckets are
+	// queried concurrently.
+	m sync.Mutex
+}
+
+// findNodeRecordJSON records a single FIND_NODE request and its response.
+// The fields Peers and Error are mutually exclusive.
+type findNodeRecordJSON struct {
+	CPL       uint8           `json:"cpl"`
+	Target    []byte          `json:"target"`
+	Peers     []peer.AddrInfo `json:"peers,omitempty"`
+	Error     *string         `json:"error,omitempty"`
+	ErrorCode *ErrorCode      `json:"error_code,omitempty"`
+}
+
+// setDials records the per-address dials.
+// It is a no-op on a nil record, as are the other setters.
+func (r *probeRecordJSON) setDials(dials []addrDial) {
+	if r == nil {
+		return
+	}
+	r.Dials = addrDialsToJSON(dials)
+}
+
+// setDialError records that dialing the peer failed.
+func (r *probeRecordJSON) setDialError(err error) {
+	if r == nil {
+		return
+	}
+	r.DialError = errorToString(err)
+	r.DialErrorCode = errorCodeToString(err)
+}
+
+// setStreamError records that no stream could be opened to the peer.
+func (r *probeRecordJSON) setStreamError(err error) {
+	if r == nil {
+		return
+	}
+	r.StreamError = errorToString(err)
+	r.StreamErrorCode = errorCodeToString(err)
+}
+
+// addFindNode records a FIND_NODE request and its response.
+func (r *probeRecordJSON) addFindNode(cpl uint8, target []byte, peers []peer.AddrInfo, err error) {
+	if r == nil {
+		return
+	}
+	err = classifyError(err, phaseFindNode)
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.FindNode = append(r.FindNode, findNodeRecordJSON{
+		CPL:       cpl,
+		Target:    target,
+		Peers:     peers,
+		Error:     errorToString(err),
+		ErrorCode: errorCodeToString(err),
+	})
+}
+
+// setNode records the results of probing the peer.
+func (r *probeRecordJSON) setNode(node *rawNodeInformation) error {
+	if r == nil {
+		return nil
+	}
+	var err error
+	r.Node, err = node.toJSON()
+	return err
+}
+
+// A recorder writes a recording to a file.
+// It is shared by all local workers of a CrawlManager.
+type recorder struct {
+	m       sync.Mutex
+	f       *os.File
+	w       io.WriteCloser
+	enc     *json.Encoder
+	started bool
+}
+
+// newRecorder creates a recorder which writes to the given file, replacing it
+// if it exists.
+// The file is compressed if its name ends in ".zst".
+func newRecorder(path string) (*recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create recording: %w", err)
+	}
+	var w io.WriteCloser = f
+	if strings.HasSuffix(path, ".zst") {
+		w = zstd.NewWriter(f)
+	}
+	return &recorder{
+		f:   f,
+		w:   w,
+		enc: json.NewEncoder(w),
+	}, nil
+}
+
+// start writes the header of the recording, unless it was written before.
+func (r *recorder) start(startTs time.Time, peers []peer.AddrInfo) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.started {
+		return nil
+	}
+	r.started = true
+	err := r.enc.Encode(recordingHeaderJSON{
+		Version: recordingVersion,
+		StartTs: startTs,
+		Peers:   peers,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write recording: %w", err)
+	}
+	return nil
+}
+
+// newProbe creates a record for a probe of the given peer, which is started
+// now.
+// Returns nil for a nil recorder, which disables recording.
+func (r *recorder) newProbe(p peer.AddrInfo) *probeRecordJSON {
+	if r == nil {
+		return nil
+	}
+	return &probeRecordJSON{
+		Peer:    p.ID,
+		Addrs:   p.Addrs,
+		StartTs: time.Now(),
+	}
+}
+
+// finish appends the given record to the recording.
+// Failures are logged, since they should not affect the crawl.
+func (r *recorder) finish(rec *probeRecordJSON) {
+	if r == nil {
+		return
+	}
+	rec.EndTs = time.Now()
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	err := r.enc.Encode(rec)
+	if err != nil {
+		log.WithError(err).WithField("peer", rec.Peer).Error("unable to record probe")
+	}
+}
+
+// close flushes and closes the recording.
+func (r *recorder) close() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.w != r.f {
+		err := r.w.Close()
+		if err != nil {
+			_ = r.f.Close()
+			return fmt.Errorf("unable to write recording: %w", err)
+		}
+	}
+	err := r.f.Close()
+	if err != nil {
+		return fmt.Errorf("unable to write recording: %w", err)
+	}
+	return nil
+}
+
+// A recording holds the probes of a recording that have not been replayed
+// yet.
+type recording struct {
+	header recordingHeaderJSON
+
+	m      sync.Mutex
+	probes map[peer.ID][]*probeRecordJSON
+}
+
+// loadRecording reads a recording written by a recorder.
+// A truncated last line, e.g., because the crawler was killed, is ignored.
+func loadRecording(path string) (*recording, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open recording: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".zst") {
+		compressed := zstd.NewReader(f)
+		defer func() { _ = compressed.Close() }()
+		r = compressed
+	}
+
+	dec := json.NewDecoder(r)
+	res := &recording{probes: make(map[peer.ID][]*probeRecordJSON)}
+	err = dec.Decode(&res.header)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode recording header: %w", err)
+	}
+	if res.header.Version != recordingVersion {
+		return nil, fmt.Errorf("unsupported recording version %d", res.header.Version)
+	}
+
+	num := 0
+	for {
+		rec := new(probeRecordJSON)
+		err = dec.Decode(rec)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			log.WithError(err).WithField("path", path).Warn("recording is truncated, ignoring the rest")
+			break
+		}
+		res.probes[rec.Peer] = append(res.probes[rec.Peer], rec)
+		num++
+	}
+
+	log.WithFields(log.Fields{
+		"path":   path,
+		"peers":  len(res.probes),
+		"probes": num,
+	}).Info("loaded recording")
+
+	return res, nil
+}
+
+// next removes the next recorded probe of the given peer and returns it, or
+// nil if there is none left.
+func (r *recording) next(id peer.ID) *probeRecordJSON {
+	r.m.Lock()
+	defer r.m.Unlock()
+	probes := r.probes[id]
+	if len(probes) == 0 {
+		return nil
+	}
+	r.probes[id] = probes[1:]
+	return probes[0]
+}
+
+// replayWorker implements worker by replaying the probes of a recording.
+// The n-th probe of a peer returns what the n-th recorded probe of that peer
+// observed, regardless of the addresses used. Peers are never contacted.
+// FIND_NODE responses are fed through the same logic as for live crawls, so
+// changes to it are reflected in the replayed crawl.
+type replayWorker struct {
+	recording *recording
+	crawler   *crawler
+}
+
+// newReplayWorker creates a worker which replays the given recording.
+// Multiple workers may share the recording.
+func newReplayWorker(r *recording, crawlerConfig CrawlerConfig) (*replayWorker, error) {
+	c, err := newCrawler(nil, crawlerConfig, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create crawler plugin: %w", err)
+	}
+	return &replayWorker{
+		recording: r,
+		crawler:   c,
+	}, nil
+}
+
+// crawlPeer implements worker.
+// Peers which were probed fewer times in the recording fail with
+// ErrorCodeNotRecorded.
+func (w *replayWorker) crawlPeer(p peer.AddrInfo) (*rawNodeInformation, []addrDial, error) {
+	rec := w.recording.next(p.ID)
+	if rec == nil {
+		return nil, nil, &classifiedError{code: ErrorCodeNotRecorded, err: fmt.Errorf("dial: no recorded probe of %s left", p.ID)}
+	}
+	dials := addrDialsFromJSON(rec.Dials)
+	if rec.DialError != nil {
+		return nil, dials, errorFromString(rec.DialError, rec.DialErrorCode)
+	}
+	if rec.Node == nil {
+		return nil, dials, fmt.Errorf("invalid recording: no result for probe of %s", p.ID)
+	}
+
+	node := rec.Node.toRawNodeInformation()
+	node.crawlData.result, node.crawlData.err = w.replayNeighbors(rec)
+	return node, dials, nil
+}
+
+// replayNeighbors obtains the neighbors of a peer from the FIND_NODE
+// responses of the given record.
+func (w *replayWorker) replayNeighbors(rec *probeRecordJSON) (*crawlData, error) {
+	if rec.StreamError != nil {
+		return nil, fmt.Errorf("unable to open stream: %w", errorFromString(rec.StreamError, rec.StreamErrorCode))
+	}
+
+	var m sync.Mutex
+	pending := rec.FindNode
+	return w.crawler.crawlNeighbors(rec.Peer, func(_ context.Context, cpl uint8) ([]byte, []peer.AddrInfo, error) {
+		m.Lock()
+		defer m.Unlock()
+		for i, fn := range pending {
+			if fn.CPL != cpl {
+				continue
+			}
+			pending = append(pending[:i:i], pending[i+1:]...)
+			if fn.Error != nil {
+				return fn.Target, nil, errorFromString(fn.Error, fn.ErrorCode)
+			}
+			return fn.Target, fn.Peers, nil
+		}
+		return nil, nil, &classifiedError{code: ErrorCodeNotRecorded, err: fmt.Errorf("no recorded FIND_NODE response for CPL %d", cpl)}
+	})
+}
+
+// stop implements worker.
+func (w *replayWorker) stop() error {
+	return w.crawler.Shutdown()
+}
@@ -0,0 +1,337 @@
+package crawling
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	log "github.com/sirupsen/logrus"
+)
+
+// RemoteWorkerConfig configures a worker running in a separate process,
+// possibly on another machine, which is reached via HTTP.
+// See WorkerServer for the other end.
+type RemoteWorkerConfig struct {
+	// The base URL of the WorkerServer, e.g., http://10.0.0.2:7070.
+	URL string `yaml:"url"`
+
+	// The timeout for a single request, including probing the peer.
+	// If zero, requests do not time out.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c RemoteWorkerConfig) check() error {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid url: unsupported scheme %q", u.Scheme)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("invalid timeout")
+	}
+	return nil
+}
+
+// workerInfoJSON is the response of a WorkerServer to an info request.
+type workerInfoJSON struct {
+	Name string `json:"name"`
+}
+
+// remoteCrawlResponseJSON is the response of a WorkerServer to a crawl
+// request.
+// The fields Error and Node are mutually exclusive, Dials may be set with
+// either.
+type remoteCrawlResponseJSON struct {
+	Error     *string                 `json:"error"`
+	ErrorCode *ErrorCode              `json:"error_code"`
+	Dials     []addrDialJSON          `json:"dials,omitempty"`
+	Node      *rawNodeInformationJSON `json:"node"`
+}
+
+// rawNodeInformationJSON is a helper struct to serialize a rawNodeInformation
+// to JSON.
+// The fields CrawlError and CrawlData are mutually exclusive.
+type rawNodeInformationJSON struct {
+	ConnectedAddr ma.Multiaddr                          `json:"connected_addr,omitempty"`
+	Info          PeerMetadata                          `json:"info"`
+	PluginResults map[string]pluginResultCheckpointJSON `json:"plugin_results"`
+
+	IdentifyError     *string    `json:"identify_error"`
+	IdentifyErrorCode *ErrorCode `json:"identify_error_code"`
+
+	Timings Timings `json:"timings"`
+
+	PingSamples   []time.Duration `json:"ping_samples"`
+	PingError     *string         `json:"ping_error"`
+	PingErrorCode *ErrorCode      `json:"ping_error_code"`
+
+	CrawlBeginTs   time.Time      `json:"crawl_begin_ts"`
+	CrawlEndTs     time.Time      `json:"crawl_end_ts"`
+	CrawlError     *string        `json:"crawl_error"`
+	CrawlErrorCode *ErrorCode     `json:"crawl_error_code"`
+	CrawlData      *crawlDataJSON `json:"crawl_data"`
+}
+
+// crawlDataJSON is a helper struct to serialize a crawlData to JSON.
+type crawlDataJSON struct {
+	Neighbors       []peer.AddrInfo `json:"neighbors"`
+	CrawlStartedTs  time.Time       `json:"crawl_started_ts"`
+	CrawlFinishedTs time.Time       `json:"crawl_finished_ts"`
+
+	Buckets []bucketResultJSON `json:"buckets"`
+
+	// The last error, if only some buckets could be crawled.
+	Error     *string    `json:"error"`
+	ErrorCode *ErrorCode `json:"error_code"`
+}
+
+func (r *rawNodeInformation) toJSON() (*rawNodeInformationJSON, error) {
+	res := &rawNodeInformationJSON{
+		ConnectedAddr:     r.connectedAddr,
+		Info:              r.info,
+		IdentifyError:     errorToString(r.identifyErr),
+		IdentifyErrorCode: errorCodeToString(r.identifyErr),
+		Timings:           r.timings,
+		PingSamples:       r.pingSamples,
+		PingError:         errorToString(r.pingErr),
+		PingErrorCode:     errorCodeToString(r.pingErr),
+		CrawlBeginTs:      r.crawlData.beginTimestamp,
+		CrawlEndTs:        r.crawlData.endTimestamp,
+		CrawlError:        errorToString(r.crawlData.err),
+		CrawlErrorCode:    errorCodeToString(r.crawlData.err),
+	}
+	if r.crawlData.result != nil {
+		res.CrawlData = &crawlDataJSON{
+			Neighbors:       r.crawlData.result.neighbors,
+			CrawlStartedTs:  r.crawlData.result.crawlStartedTimestamp,
+			CrawlFinishedTs: r.crawlData.result.crawlFinishedTimestamp,
+			Buckets:         bucketResultsToJSON(r.crawlData.result.buckets),
+			Error:           errorToString(r.crawlData.result.err),
+			ErrorCode:       errorCodeToString(r.crawlData.result.err),
+		}
+	}
+	if len(r.pluginResults) != 0 {
+		res.PluginResults = make(map[string]pluginResultCheckpointJSON)
+		for pn, pd := range r.pluginResults {
+			result, err := json.Marshal(pd.result)
+			if err != nil {
+				return nil, fmt.Errorf("unable to encode result of plugin %s: %w", pn, err)
+			}
+			res.PluginResults[pn] = pluginResultCheckpointJSON{
+				BeginTimestamp: pd.beginTimestamp,
+				EndTimestamp:   pd.endTimestamp,
+				Error:          errorToString(pd.err),
+				ErrorCode:      errorCodeToString(pd.err),
+				Result:         result,
+			}
+		}
+	}
+	return res, nil
+}
+
+func (r *rawNodeInformationJSON) toRawNodeInformation() *rawNodeInformation {
+	res := &rawNodeInformation{
+		connectedAddr: r.ConnectedAddr,
+		info:          r.Info,
+		identifyErr:   errorFromString(r.IdentifyError, r.IdentifyErrorCode),
+		timings:       r.Timings,
+		pingSamples:   r.PingSamples,
+		pingErr:       errorFromString(r.PingError, r.PingErrorCode),
+		crawlData: crawlResult{
+			beginTimestamp: r.CrawlBeginTs,
+			endTimestamp:   r.CrawlEndTs,
+			err:            errorFromString(r.CrawlError, r.CrawlErrorCode),
+		},
+	}
+	if r.CrawlData != nil {
+		res.crawlData.result = &crawlData{
+			neighbors:              r.CrawlData.Neighbors,
+			crawlStartedTimestamp:  r.CrawlData.CrawlStartedTs,
+			crawlFinishedTimestamp: r.CrawlData.CrawlFinishedTs,
+			buckets:                bucketResultsFromJSON(r.CrawlData.Buckets),
+			err:                    errorFromString(r.CrawlData.Error, r.CrawlData.ErrorCode),
+		}
+	}
+	if len(r.PluginResults) != 0 {
+		res.pluginResults = make(map[string]pluginResult)
+		for pn, pd := range r.PluginResults {
+			res.pluginResults[pn] = pluginResult{
+				beginTimestamp: pd.BeginTimestamp,
+				endTimestamp:   pd.EndTimestamp,
+				err:            errorFromString(pd.Error, pd.ErrorCode),
+				result:         pd.Result,
+			}
+		}
+	}
+	return res
+}
+
+// A WorkerServer makes a Libp2pWorker available to CrawlManagers in other
+// processes via HTTP.
+// It serves two endpoints: GET /info returns the name of the worker, and
+// POST /crawl probes the peer given as a JSON-encoded peer.AddrInfo.
+// There is no authentication, so it should only be reachable from trusted
+// networks.
+type WorkerServer struct {
+	name   string
+	worker *Libp2pWorker
+	mux    *http.ServeMux
+}
+
+// NewWorkerServer creates a new WorkerServer for the given worker.
+// The name is reported to CrawlManagers and recorded in their output.
+func NewWorkerServer(name string, worker *Libp2pWorker) *WorkerServer {
+	s := &WorkerServer{
+		name:   name,
+		worker: worker,
+		mux:    http.NewServeMux(),
+	}
+	s.mux.HandleFunc("GET /info", s.handleInfo)
+	s.mux.HandleFunc("POST /crawl", s.handleCrawl)
+	return s
+}
+
+// Close shuts down the worker.
+// The WorkerServer must not be used afterwards.
+func (s *WorkerServer) Close() error {
+	return s.worker.stop()
+}
+
+// ServeHTTP implements http.Handler.
+func (s *WorkerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *WorkerServer) handleInfo(w http.ResponseWriter, _ *http.Request) {
+	writeJSONResponse(w, workerInfoJSON{Name: s.name})
+}
+
+func (s *WorkerServer) handleCrawl(w http.ResponseWriter, r *http.Request) {
+	var p peer.AddrInfo
+	err := json.NewDecoder(r.Body).Decode(&p)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to decode peer: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	var res remoteCrawlResponseJSON
+	node, dials, err := s.worker.crawlPeer(p)
+	res.Dials = addrDialsToJSON(dials)
+	if err != nil {
+		res.Error = errorToString(err)
+		res.ErrorCode = errorCodeToString(err)
+	} else {
+		res.Node, err = node.toJSON()
+		if err != nil {
+			log.WithError(err).WithField("peer", p.ID).Error("unable to encode crawl result")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSONResponse(w, res)
+}
+
+// writeJSONResponse writes v as the JSON-encoded body of a response.
+func writeJSONResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.WithError(err).Debug("unable to write response")
+	}
+}
+
+// remoteWorker implements worker by delegating to a WorkerServer.
+type remoteWorker struct {
+	config RemoteWorkerConfig
+	name   string
+	client *http.Client
+}
+
+// newRemoteWorker connects to the WorkerServer at the configured URL.
+// maxConns is the number of concurrent requests the worker is used for.
+func newRemoteWorker(config RemoteWorkerConfig, maxConns int) (*remoteWorker, error) {
+	err := config.check()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = maxConns
+	w := &remoteWorker{
+		config: config,
+		client: &http.Client{Transport: transport, Timeout: config.Timeout},
+	}
+
+	resp, err := w.client.Get(config.URL + "/info")
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach remote worker: %w", err)
+	}
+	var info workerInfoJSON
+	err = decodeJSONResponse(resp, &info)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get info of remote worker: %w", err)
+	}
+	w.name = info.Name
+
+	return w, nil
+}
+
+// crawlPeer implements worker.
+// Failures to reach the WorkerServer are reported as connection errors with
+// ErrorCodeWorkerFailed.
+func (w *remoteWorker) crawlPeer(p peer.AddrInfo) (*rawNodeInformation, []addrDial, error) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to encode peer: %w", err)
+	}
+
+	resp, err := w.client.Post(w.config.URL+"/crawl", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, &classifiedError{code: ErrorCodeWorkerFailed, err: fmt.Errorf("remote worker %s: %w", w.name, err)}
+	}
+	var res remoteCrawlResponseJSON
+	err = decodeJSONResponse(resp, &res)
+	if err != nil {
+		return nil, nil, &classifiedError{code: ErrorCodeWorkerFailed, err: fmt.Errorf("remote worker %s: %w", w.name, err)}
+	}
+
+	dials := addrDialsFromJSON(res.Dials)
+	if res.Node == nil {
+		err = errorFromString(res.Error, res.ErrorCode)
+		if err == nil {
+			return nil, dials, &classifiedError{code: ErrorCodeWorkerFailed, err: fmt.Errorf("remote worker %s: empty response", w.name)}
+		}
+		return nil, dials, err
+	}
+	return res.Node.toRawNodeInformation(), dials, nil
+}
+
+// stop implements worker.
+// The WorkerServer keeps running.
+func (w *remoteWorker) stop() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
+
+// decodeJSONResponse decodes the JSON-encoded body of a successful response
+// into v and closes the body.
+func decodeJSONResponse(resp *http.Response, v interface{}) error {
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	err := json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("unable to decode response: %w", err)
+	}
+	return nil
+}
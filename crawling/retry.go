@@ -0,0 +1,300 @@
+package crawling
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	log "github.com/sirupsen/logrus"
+)
+
+// RetryConfig configures when peers are probed again after a failed attempt.
+// An attempt failed if we could not connect to the peer or not obtain its
+// neighbors.
+type RetryConfig struct {
+	// The maximum number of attempts per peer, including the first one.
+	// This also limits attempts caused by learning new addresses of a peer.
+	// If zero, peers are only probed again if new addresses are learned, as
+	// often as that happens. If one, peers are never probed again.
+	// Otherwise, peers which failed with a retryable error are probed again
+	// after a backoff.
+	MaxAttempts uint `yaml:"max_attempts"`
+
+	// The backoff before the first retry.
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+
+	// The maximum backoff between retries. If zero, the backoff is unbounded.
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+
+	// The factor by which the backoff grows with every retry.
+	// Defaults to 2.
+	Multiplier float64 `yaml:"multiplier"`
+
+	// Errors with these codes are permanent, i.e., not retried after a
+	// backoff. All other errors are retryable.
+	// Defaults to no_addresses, no_transport, peer_id_mismatch and
+	// protocol_not_supported.
+	PermanentErrors []ErrorCode `yaml:"permanent_errors"`
+}
+
+func (c *RetryConfig) check() error {
+	for _, code := range c.PermanentErrors {
+		if _, ok := errorCodes[code]; !ok {
+			return fmt.Errorf("unknown error code %q in permanent_errors", code)
+		}
+	}
+	if c.MaxAttempts <= 1 {
+		return nil
+	}
+	if c.InitialBackoff <= 0 {
+		return fmt.Errorf("missing or invalid initial_backoff")
+	}
+	if c.MaxBackoff < 0 || (c.MaxBackoff > 0 && c.MaxBackoff < c.InitialBackoff) {
+		return fmt.Errorf("invalid max_backoff")
+	}
+	if c.Multiplier != 0 && c.Multiplier < 1 {
+		return fmt.Errorf("invalid multiplier")
+	}
+	return nil
+}
+
+// enabled returns whether failed peers are retried after a backoff.
+func (c *RetryConfig) enabled() bool {
+	return c.MaxAttempts > 1
+}
+
+// backoff returns the backoff after the given number of failed attempts.
+func (c *RetryConfig) backoff(failures int) time.Duration {
+	multiplier := c.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	backoff := float64(c.InitialBackoff) * math.Pow(multiplier, float64(failures-1))
+	if c.MaxBackoff > 0 && backoff > float64(c.MaxBackoff) {
+		return c.MaxBackoff
+	}
+	if backoff > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(backoff)
+}
+
+// crawlAttempt is the outcome of a single attempt to probe a peer.
+// The fields err and result are mutually exclusive.
+type crawlAttempt struct {
+	startTs time.Time
+	endTs   time.Time
+
+	// The addresses we knew for the peer when the attempt was started.
+	addrs []ma.Multiaddr
+
+	// The name of the worker which probed the peer, if any.
+	worker string
+
+	// The outcome of dialing each address, if they were dialed separately.
+	dials []addrDial
+
+	err    error
+	result *nodeInformation
+
+	// The number of neighbors obtained. This is kept separately, since the
+	// neighbors themselves are dropped once they were streamed to disk.
+	numNeighbors int
+
+	// Whether the attempt may be retried, if it failed or crawled the peer
+	// only partially.
+	retryable bool
+}
+
+// failure returns the connection error or, if we could connect, the crawl
+// error of the attempt.
+func (a crawlAttempt) failure() error {
+	if a.err != nil {
+		return a.err
+	}
+	return a.result.crawlDataError
+}
+
+// lastError returns the failure of the attempt or, if it crawled the peer
+// only partially, the last error encountered while doing so.
+func (a crawlAttempt) lastError() error {
+	if err := a.failure(); err != nil {
+		return err
+	}
+	return a.result.crawlDataPartialError
+}
+
+// rank orders attempts by how far they got: attempts that crawled the peer
+// completely rank above attempts that crawled it partially, which rank above
+// attempts that only connected, which rank above attempts that failed to
+// connect, which rank above attempts that were abandoned.
+func (a crawlAttempt) rank() int {
+	switch {
+	case isAbandoned(a.err):
+		return -1
+	case a.err != nil:
+		return 0
+	case a.result.crawlDataError != nil:
+		return 1
+	case a.result.crawlDataPartialError != nil:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// mergeAttempts returns the status of a peer with the given attempts.
+// The status is taken from the best attempt, i.e., the one with the highest
+// rank, preferring later attempts among equals. This way, a failed attempt
+// with new addresses does not overwrite what we learned before.
+func mergeAttempts(attempts []crawlAttempt) nodeCrawlStatus {
+	best := 0
+	for i, a := range attempts {
+		if a.rank() >= attempts[best].rank() {
+			best = i
+		}
+	}
+	b := attempts[best]
+	return nodeCrawlStatus{
+		startTs:  b.startTs,
+		endTs:    b.endTs,
+		worker:   b.worker,
+		err:      b.err,
+		result:   b.result,
+		attempts: attempts,
+	}
+}
+
+// defaultPermanentErrors are the error codes which are not retried, unless
+// configured otherwise. These errors will recur unless the peer changes.
+var defaultPermanentErrors = []ErrorCode{
+	ErrorCodeNoAddresses,
+	ErrorCodeNoTransport,
+	ErrorCodePeerIDMismatch,
+	ErrorCodeProtocolNotSupported,
+}
+
+// retryable returns whether probing a peer again after the given error may
+// succeed.
+// Abandoned attempts are never retried, since the crawl is over.
+func (c *RetryConfig) retryable(err error) bool {
+	code := ErrorCodeOf(err)
+	if code == ErrorCodeCrawlDeadlineExceeded || code == ErrorCodeCrawlInterrupted {
+		return false
+	}
+	permanent := c.PermanentErrors
+	if permanent == nil {
+		permanent = defaultPermanentErrors
+	}
+	for _, p := range permanent {
+		if code == p {
+			return false
+		}
+	}
+	return true
+}
+
+// pendingRetry is an entry in a retryHeap.
+type pendingRetry struct {
+	id peer.ID
+	at time.Time
+}
+
+// retryHeap is a min-heap of peers to retry, by time of the retry.
+type retryHeap []pendingRetry
+
+func (h retryHeap) Len() int { return len(h) }
+
+func (h retryHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h retryHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *retryHeap) Push(x interface{}) {
+	*h = append(*h, x.(pendingRetry))
+}
+
+func (h *retryHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// deferPeer makes the given peer wait until the given time before it is
+// queued again.
+func (cm *CrawlManager) deferPeer(id peer.ID, at time.Time) {
+	if prev, ok := cm.deferredUntil[id]; ok && !at.After(prev) {
+		return
+	}
+	cm.deferredUntil[id] = at
+	heap.Push(&cm.deferred, pendingRetry{id: id, at: at})
+}
+
+// releaseDeferred queues all deferred peers whose time has come.
+func (cm *CrawlManager) releaseDeferred(now time.Time) {
+	for cm.deferred.Len() != 0 && !cm.deferred[0].at.After(now) {
+		item := heap.Pop(&cm.deferred).(pendingRetry)
+		if at, ok := cm.deferredUntil[item.id]; !ok || at.After(item.at) {
+			// Superseded by a later entry.
+			continue
+		}
+		delete(cm.deferredUntil, item.id)
+		cm.toCrawl.enqueue(item.id)
+	}
+}
+
+// attemptAllowed returns whether we may probe the given peer now, as far as
+// the retry policy is concerned.
+func (cm *CrawlManager) attemptAllowed(id peer.ID, now time.Time) bool {
+	if at, ok := cm.deferredUntil[id]; ok && now.Before(at) {
+		// It will be queued again once the backoff expires.
+		return false
+	}
+	maxAttempts := cm.config.Retry.MaxAttempts
+	return maxAttempts == 0 || uint(len(cm.crawled[id].attempts)) < maxAttempts
+}
+
+// crawledEnough returns whether the given peer was crawled successfully, i.e.,
+// completely or, unless PartialCrawlConfig.Retry is set, partially.
+func (cm *CrawlManager) crawledEnough(id peer.ID) bool {
+	status, ok := cm.crawled[id]
+	if !ok || status.err != nil || status.result.crawlDataError != nil {
+		return false
+	}
+	return !cm.config.PartialCrawls.Retry || status.result.crawlDataPartialError == nil
+}
+
+// scheduleRetry defers a retry of the given peer if its last attempt failed
+// with a retryable error, it has attempts left and no earlier attempt
+// succeeded.
+// If PartialCrawlConfig.Retry is set, attempts that crawled the peer only
+// partially count as failed, unless an earlier attempt crawled it completely.
+func (cm *CrawlManager) scheduleRetry(id peer.ID) {
+	if !cm.config.Retry.enabled() {
+		return
+	}
+	status := cm.crawled[id]
+	attempts := status.attempts
+	last := attempts[len(attempts)-1]
+	retryPartial := cm.config.PartialCrawls.Retry
+	if last.failure() == nil && (!retryPartial || last.result.crawlDataPartialError == nil) {
+		return
+	}
+	if !last.retryable || uint(len(attempts)) >= cm.config.Retry.MaxAttempts {
+		return
+	}
+	if cm.crawledEnough(id) {
+		return
+	}
+
+	backoff := cm.config.Retry.backoff(len(attempts))
+	cm.logger.WithFields(log.Fields{
+		"peer":    id,
+		"attempt": len(attempts),
+		"backoff": backoff,
+	}).Debug("scheduling retry")
+	cm.deferPeer(id, last.endTs.Add(backoff))
+}
@@ -0,0 +1,154 @@
+package crawling
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	msmux "github.com/multiformats/go-multistream"
+	log "github.com/sirupsen/logrus"
+)
+
+// RTTSource says how the round-trip times to a peer were measured.
+type RTTSource string
+
+const (
+	// RTTSourcePing means that the peer was pinged.
+	RTTSourcePing RTTSource = "ping"
+
+	// RTTSourceFindNode means that the round-trip times were taken from the
+	// FIND_NODE requests sent to the peer, because it could not be pinged.
+	// These include the time the peer took to process the request, and the
+	// first request may include negotiating the DHT protocol, so the minimum
+	// is the best estimate.
+	RTTSourceFindNode RTTSource = "find_node"
+)
+
+// RTT summarizes the round-trip times measured to a peer.
+// All fields but Transport are zero if no round-trip time could be measured.
+type RTT struct {
+	Source  RTTSource
+	Samples []time.Duration
+
+	Min    time.Duration
+	Median time.Duration
+	Max    time.Duration
+
+	// The transport of the connection the samples were measured on.
+	Transport Transport
+}
+
+// newRTT summarizes the given samples, which must not be empty.
+func newRTT(source RTTSource, samples []time.Duration, transport Transport) RTT {
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	median := sorted[len(sorted)/2]
+	if len(sorted)%2 == 0 {
+		median = (sorted[len(sorted)/2-1] + median) / 2
+	}
+	return RTT{
+		Source:    source,
+		Samples:   samples,
+		Min:       sorted[0],
+		Median:    median,
+		Max:       sorted[len(sorted)-1],
+		Transport: transport,
+	}
+}
+
+// rtt returns the round-trip times measured to the peer, preferring ping
+// samples over FIND_NODE requests.
+func (r *nodeInformation) rtt() RTT {
+	transport := TransportUnknown
+	if r.connectedAddr != nil {
+		transport = transportOf(r.connectedAddr)
+	}
+	if len(r.pingSamples) != 0 {
+		return newRTT(RTTSourcePing, r.pingSamples, transport)
+	}
+	var samples []time.Duration
+	for _, b := range r.crawlBuckets {
+		if b.err == nil && b.latency > 0 {
+			samples = append(samples, b.latency)
+		}
+	}
+	if len(samples) != 0 {
+		return newRTT(RTTSourceFindNode, samples, transport)
+	}
+	return RTT{Transport: transport}
+}
+
+// pingConn pings the peer on the given connection the given number of times,
+// one after another on a single stream, and returns the round-trip times.
+// Each ping times out after the given timeout, as does opening the stream.
+// If a ping fails, the round-trip times measured before are returned along
+// with the error.
+func pingConn(c network.Conn, samples uint, timeout time.Duration) ([]time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	s, err := c.NewStream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open ping stream: %w", err)
+	}
+	defer func() { _ = s.Reset() }()
+
+	_ = s.SetDeadline(time.Now().Add(timeout))
+	err = s.SetProtocol(ping.ID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to set ping protocol: %w", err)
+	}
+	err = msmux.SelectProtoOrFail(ping.ID, s)
+	if err != nil {
+		return nil, fmt.Errorf("unable to negotiate ping protocol: %w", err)
+	}
+
+	var rtts []time.Duration
+	buf := make([]byte, ping.PingSize)
+	resp := make([]byte, ping.PingSize)
+	for uint(len(rtts)) < samples {
+		_, err = rand.Read(buf)
+		if err != nil {
+			return rtts, fmt.Errorf("unable to generate ping: %w", err)
+		}
+		_ = s.SetDeadline(time.Now().Add(timeout))
+		sentTs := time.Now()
+		_, err = s.Write(buf)
+		if err != nil {
+			return rtts, fmt.Errorf("unable to send ping: %w", err)
+		}
+		_, err = io.ReadFull(s, resp)
+		if err != nil {
+			return rtts, fmt.Errorf("unable to read ping response: %w", err)
+		}
+		rtt := time.Since(sentTs)
+		if !bytes.Equal(buf, resp) {
+			return rtts, &classifiedError{code: ErrorCodeInvalidResponse, err: fmt.Errorf("ping response does not match")}
+		}
+		rtts = append(rtts, rtt)
+	}
+	return rtts, nil
+}
+
+// ping measures the round-trip time to the peer on the given connection, if
+// enabled.
+func (w *Libp2pWorker) ping(c network.Conn) ([]time.Duration, error) {
+	if w.config.PingSamples == 0 {
+		return nil, nil
+	}
+	rtts, err := pingConn(c, w.config.PingSamples, w.config.pingTimeout())
+	if err != nil {
+		err = classifyError(err, phasePing)
+		log.WithFields(log.Fields{
+			"err":     err,
+			"samples": len(rtts),
+			"peerID":  c.RemotePeer(),
+		}).Debug("could not ping peer")
+	}
+	return rtts, err
+}
@@ -0,0 +1,290 @@
+package crawling
+
+import (
+	"container/heap"
+	"fmt"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Names of the built-in scheduling policies, as used in the configuration.
+const (
+	// SchedulingFIFO crawls peers in the order in which they were discovered.
+	SchedulingFIFO = "fifo"
+
+	// SchedulingMostReferenced crawls peers that were reported by the most
+	// neighbors first.
+	SchedulingMostReferenced = "most_referenced"
+
+	// SchedulingKeyspaceRoundRobin partitions the Kademlia keyspace into
+	// regions by ID prefix and crawls one peer of each region in turn.
+	SchedulingKeyspaceRoundRobin = "keyspace_round_robin"
+
+	// SchedulingAddressType crawls peers with public QUIC addresses first,
+	// followed by peers with other public addresses, relayed peers and,
+	// lastly, peers without any public addresses.
+	SchedulingAddressType = "address_type"
+)
+
+// keyspaceRegionBits is the length of the ID prefix used to partition the
+// keyspace for SchedulingKeyspaceRoundRobin.
+const keyspaceRegionBits = 8
+
+// A schedulingPolicy decides the order in which queued peers are crawled.
+// It is not safe for concurrent use.
+type schedulingPolicy interface {
+	// add enqueues the given peer, which is not currently queued.
+	add(id peer.ID, addrs []ma.Multiaddr)
+
+	// next removes the next peer to crawl from the queue and returns it.
+	// It is only called if at least one peer is queued.
+	next() peer.ID
+
+	// referenced notifies the policy that a neighbor reported the given
+	// peer, which may or may not be queued.
+	referenced(id peer.ID)
+
+	// queued returns all queued peers, in the order they would be crawled.
+	queued() []peer.ID
+}
+
+// newSchedulingPolicy creates the built-in scheduling policy with the given
+// name. An empty name selects SchedulingFIFO.
+func newSchedulingPolicy(name string) (schedulingPolicy, error) {
+	switch name {
+	case "", SchedulingFIFO:
+		return &fifoPolicy{}, nil
+	case SchedulingMostReferenced:
+		return &mostReferencedPolicy{
+			references: make(map[peer.ID]uint),
+			items:      make(map[peer.ID]*referencedPeer),
+		}, nil
+	case SchedulingKeyspaceRoundRobin:
+		return &keyspacePolicy{}, nil
+	case SchedulingAddressType:
+		return &addressTypePolicy{}, nil
+	default:
+		return nil, fmt.Errorf("unknown scheduling policy %q", name)
+	}
+}
+
+// fifoPolicy implements SchedulingFIFO.
+type fifoPolicy struct {
+	queue []peer.ID
+}
+
+func (p *fifoPolicy) add(id peer.ID, _ []ma.Multiaddr) {
+	p.queue = append(p.queue, id)
+}
+
+func (p *fifoPolicy) next() peer.ID {
+	var id peer.ID
+	id, p.queue = p.queue[0], p.queue[1:]
+	return id
+}
+
+func (*fifoPolicy) referenced(peer.ID) {}
+
+func (p *fifoPolicy) queued() []peer.ID {
+	return append([]peer.ID(nil), p.queue...)
+}
+
+// referencedPeer is an entry in the heap of mostReferencedPolicy.
+type referencedPeer struct {
+	id    peer.ID
+	refs  uint
+	seq   uint64
+	index int
+}
+
+// referencedPeerHeap is a max-heap of peers by number of references.
+// Ties are broken by insertion order.
+type referencedPeerHeap []*referencedPeer
+
+func (h referencedPeerHeap) Len() int { return len(h) }
+
+func (h referencedPeerHeap) Less(i, j int) bool {
+	if h[i].refs != h[j].refs {
+		return h[i].refs > h[j].refs
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h referencedPeerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *referencedPeerHeap) Push(x interface{}) {
+	item := x.(*referencedPeer)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *referencedPeerHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// mostReferencedPolicy implements SchedulingMostReferenced.
+// References are counted for all peers, including those not currently queued.
+type mostReferencedPolicy struct {
+	references map[peer.ID]uint
+	items      map[peer.ID]*referencedPeer
+	heap       referencedPeerHeap
+	seq        uint64
+}
+
+func (p *mostReferencedPolicy) add(id peer.ID, _ []ma.Multiaddr) {
+	item := &referencedPeer{id: id, refs: p.references[id], seq: p.seq}
+	p.seq++
+	p.items[id] = item
+	heap.Push(&p.heap, item)
+}
+
+func (p *mostReferencedPolicy) next() peer.ID {
+	item := heap.Pop(&p.heap).(*referencedPeer)
+	delete(p.items, item.id)
+	return item.id
+}
+
+func (p *mostReferencedPolicy) referenced(id peer.ID) {
+	p.references[id]++
+	if item, ok := p.items[id]; ok {
+		item.refs = p.references[id]
+		heap.Fix(&p.heap, item.index)
+	}
+}
+
+func (p *mostReferencedPolicy) queued() []peer.ID {
+	tmp := make(referencedPeerHeap, 0, len(p.heap))
+	for _, item := range p.heap {
+		c := *item
+		tmp = append(tmp, &c)
+	}
+	heap.Init(&tmp)
+
+	res := make([]peer.ID, 0, len(tmp))
+	for tmp.Len() != 0 {
+		res = append(res, heap.Pop(&tmp).(*referencedPeer).id)
+	}
+	return res
+}
+
+// keyspacePolicy implements SchedulingKeyspaceRoundRobin.
+type keyspacePolicy struct {
+	regions [1 << keyspaceRegionBits][]peer.ID
+	cursor  int
+}
+
+// keyspaceRegion returns the keyspace region of the given peer.
+func keyspaceRegion(id peer.ID) int {
+	// This only works for up to eight bits.
+	return int(kb.ConvertPeerID(id)[0] >> (8 - keyspaceRegionBits))
+}
+
+func (p *keyspacePolicy) add(id peer.ID, _ []ma.Multiaddr) {
+	r := keyspaceRegion(id)
+	p.regions[r] = append(p.regions[r], id)
+}
+
+func (p *keyspacePolicy) next() peer.ID {
+	for i := 0; i < len(p.regions); i++ {
+		r := (p.cursor + i) % len(p.regions)
+		if len(p.regions[r]) == 0 {
+			continue
+		}
+		var id peer.ID
+		id, p.regions[r] = p.regions[r][0], p.regions[r][1:]
+		p.cursor = (r + 1) % len(p.regions)
+		return id
+	}
+	panic("empty queue")
+}
+
+func (*keyspacePolicy) referenced(peer.ID) {}
+
+func (p *keyspacePolicy) queued() []peer.ID {
+	var res []peer.ID
+	for round := 0; ; round++ {
+		found := false
+		for i := 0; i < len(p.regions); i++ {
+			r := (p.cursor + i) % len(p.regions)
+			if round < len(p.regions[r]) {
+				res = append(res, p.regions[r][round])
+				found = true
+			}
+		}
+		if !found {
+			return res
+		}
+	}
+}
+
+// Address classes of addressTypePolicy, in order of priority.
+const (
+	addressClassPublicQUIC = iota
+	addressClassPublic
+	addressClassRelayed
+	addressClassOther
+	numAddressClasses
+)
+
+// addressClass classifies a peer by its most promising address.
+func addressClass(addrs []ma.Multiaddr) int {
+	class := addressClassOther
+	for _, addr := range addrs {
+		if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+			class = min(class, addressClassRelayed)
+			continue
+		}
+		if !manet.IsPublicAddr(addr) {
+			continue
+		}
+		if _, err := addr.ValueForProtocol(ma.P_QUIC_V1); err == nil {
+			return addressClassPublicQUIC
+		}
+		class = min(class, addressClassPublic)
+	}
+	return class
+}
+
+// addressTypePolicy implements SchedulingAddressType.
+// Peers are classified by the addresses known when they are queued.
+type addressTypePolicy struct {
+	classes [numAddressClasses][]peer.ID
+}
+
+func (p *addressTypePolicy) add(id peer.ID, addrs []ma.Multiaddr) {
+	c := addressClass(addrs)
+	p.classes[c] = append(p.classes[c], id)
+}
+
+func (p *addressTypePolicy) next() peer.ID {
+	for c := range p.classes {
+		if len(p.classes[c]) == 0 {
+			continue
+		}
+		var id peer.ID
+		id, p.classes[c] = p.classes[c][0], p.classes[c][1:]
+		return id
+	}
+	panic("empty queue")
+}
+
+func (*addressTypePolicy) referenced(peer.ID) {}
+
+func (p *addressTypePolicy) queued() []peer.ID {
+	var res []peer.ID
+	for _, class := range p.classes {
+		res = append(res, class...)
+	}
+	return res
+}
@@ -0,0 +1,397 @@
+package crawling_test
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+
+	crawlLib "ipfs-crawler/crawling"
+	"ipfs-crawler/simulation"
+)
+
+// newSimulatedCrawl creates a simulated network with the given configuration
+// and a crawl manager for it, which may be configured further by configure.
+// The crawl manager is stopped when the test ends.
+func newSimulatedCrawl(tb testing.TB, simConfig simulation.Config, configure func(*crawlLib.CrawlManagerConfig)) (*crawlLib.CrawlManager, *simulation.Network) {
+	tb.Helper()
+
+	sim, err := simulation.New(simConfig)
+	if err != nil {
+		tb.Fatalf("unable to create simulated network: %v", err)
+	}
+	config := crawlLib.CrawlManagerConfig{
+		NumWorkers:         2,
+		ConcurrentRequests: 50,
+		BootstrapPeers:     sim.BootstrapPeers(3),
+		WorkerConfig: crawlLib.WorkerConfig{
+			UserAgent:          "simulation test",
+			ConnectTimeout:     time.Second,
+			ConnectionAttempts: 1,
+		},
+		CrawlerConfig: crawlLib.CrawlerConfig{
+			InteractionTimeout:  time.Second,
+			InteractionAttempts: 1,
+			ProtocolStrings:     []protocol.ID{simulation.Protocol},
+		},
+	}
+	if configure != nil {
+		configure(&config)
+	}
+	cm, err := crawlLib.NewCrawlManagerWithNetwork(config, sim)
+	if err != nil {
+		tb.Fatalf("unable to create crawl manager: %v", err)
+	}
+	tb.Cleanup(func() {
+		err := cm.Stop()
+		if err != nil {
+			tb.Errorf("unable to stop crawl manager: %v", err)
+		}
+	})
+	return cm, sim
+}
+
+// crawlSimulation crawls a simulated network with the given configuration and
+// compares the result with the ground truth.
+func crawlSimulation(t *testing.T, simConfig simulation.Config) (crawlLib.CrawlOutput, simulation.Evaluation) {
+	t.Helper()
+
+	cm, sim := newSimulatedCrawl(t, simConfig, nil)
+	report := cm.CrawlNetwork()
+	return report, sim.Evaluate(&report)
+}
+
+// cancelAfter cancels a crawl once the given number of peers were probed.
+type cancelAfter struct {
+	crawlLib.NopObserver
+
+	m      sync.Mutex
+	n      int
+	cancel context.CancelFunc
+}
+
+func (o *cancelAfter) OnCrawlFinished(crawlLib.NodeStatus) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.n--
+	if o.n == 0 {
+		o.cancel()
+	}
+}
+
+// readPeergraph reads the rows of the peer graph at the given path, without
+// the header.
+func readPeergraph(t *testing.T, path string) [][]string {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unable to open peer graph: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("unable to read peer graph: %v", err)
+	}
+	if len(rows) == 0 || rows[0][0] != "source" {
+		t.Fatalf("peer graph has no header")
+	}
+	return rows[1:]
+}
+
+// writeOutputs writes the metadata, peer graph and node cache of the given
+// crawl to a temporary directory and checks that they can be read back.
+func writeOutputs(t *testing.T, report crawlLib.CrawlOutput) {
+	t.Helper()
+
+	dir := t.TempDir()
+	metadataPath := filepath.Join(dir, "visitedPeers.json")
+	peergraphPath := filepath.Join(dir, "peerGraph.csv")
+	cachePath := filepath.Join(dir, "nodes.cache")
+
+	err := report.WriteMetadata(time.Now(), time.Now(), metadataPath)
+	if err != nil {
+		t.Fatalf("unable to write metadata: %v", err)
+	}
+	err = report.WritePeergraph(peergraphPath)
+	if err != nil {
+		t.Fatalf("unable to write peer graph: %v", err)
+	}
+	err = report.SaveNodeCache(cachePath)
+	if err != nil {
+		t.Fatalf("unable to write node cache: %v", err)
+	}
+
+	checkMetadata(t, metadataPath, report.Partial(), report.Stats().NumNodes)
+	readPeergraph(t, peergraphPath)
+	cached, err := crawlLib.RestoreNodeCache(cachePath)
+	if err != nil {
+		t.Fatalf("unable to read node cache: %v", err)
+	}
+	if len(cached) != report.Stats().NumCrawlable {
+		t.Errorf("node cache holds %d peers, expected %d", len(cached), report.Stats().NumCrawlable)
+	}
+}
+
+// streamOutputs streams the results of a crawl by cm to a temporary
+// directory, finalizes them and checks that they can be read back.
+// It returns the crawl output and the rows of the peer graph.
+func streamOutputs(t *testing.T, cm *crawlLib.CrawlManager, crawl func() crawlLib.CrawlOutput) (crawlLib.CrawlOutput, [][]string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	metadataPath := filepath.Join(dir, "visitedPeers.json")
+	peergraphPath := filepath.Join(dir, "peerGraph.csv")
+
+	w, err := crawlLib.NewStreamingWriter(metadataPath, peergraphPath)
+	if err != nil {
+		t.Fatalf("unable to create streaming writer: %v", err)
+	}
+	cm.StreamResultsTo(w)
+	report := crawl()
+	err = w.Finalize(time.Now(), time.Now())
+	if err != nil {
+		t.Fatalf("unable to finalize streamed output: %v", err)
+	}
+
+	checkMetadata(t, metadataPath, report.Partial(), report.Stats().NumNodes)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unable to list output directory: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("output directory holds %d files, expected the intermediate files to be removed", len(entries))
+	}
+	return report, readPeergraph(t, peergraphPath)
+}
+
+// checkMetadata checks that the metadata at the given path is marked as
+// partial or not, and holds the given number of nodes.
+func checkMetadata(t *testing.T, path string, partial bool, numNodes int) {
+	t.Helper()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read metadata: %v", err)
+	}
+	var metadata struct {
+		Partial bool              `json:"partial"`
+		Nodes   []json.RawMessage `json:"found_nodes"`
+	}
+	err = json.Unmarshal(b, &metadata)
+	if err != nil {
+		t.Fatalf("unable to decode metadata: %v", err)
+	}
+	if metadata.Partial != partial || len(metadata.Nodes) != numNodes {
+		t.Errorf("metadata is partial: %t with %d nodes, expected %t with %d", metadata.Partial, len(metadata.Nodes), partial, numNodes)
+	}
+}
+
+func TestCrawlSimulatedNetwork(t *testing.T) {
+	report, e := crawlSimulation(t, simulation.Config{NumPeers: 100, BucketSize: 10, Seed: 1})
+
+	if e.NumDiscovered != e.NumDiscoverable {
+		t.Errorf("discovered %d peers, expected %d", e.NumDiscovered, e.NumDiscoverable)
+	}
+	if e.NumConnectable != e.NumReachable || e.NumCrawlable != e.NumServers {
+		t.Errorf("connected to %d and crawled %d peers, expected %d and %d", e.NumConnectable, e.NumCrawlable, e.NumReachable, e.NumServers)
+	}
+	if e.NumEdges == 0 || e.NumEdgesFound != e.NumEdges {
+		t.Errorf("found %d edges, expected %d", e.NumEdgesFound, e.NumEdges)
+	}
+	if e.NumFalsePositives != 0 || e.NumMisclassified != 0 {
+		t.Errorf("%d false positives and %d misclassified peers", e.NumFalsePositives, e.NumMisclassified)
+	}
+	if stats := report.Stats(); stats.NumNodes != e.NumDiscovered || stats.NumCrawlable != e.NumCrawlable {
+		t.Errorf("stats report %d nodes and %d crawlable nodes, expected %d and %d", stats.NumNodes, stats.NumCrawlable, e.NumDiscovered, e.NumCrawlable)
+	}
+}
+
+func TestCrawlSimulatedNetworkWithUnreachablePeers(t *testing.T) {
+	// Peers that refuse connections never make it into routing tables, but
+	// peers that left the network remain there, and peers that do not serve
+	// the DHT can be connected to, but not crawled.
+	report, e := crawlSimulation(t, simulation.Config{
+		NumPeers:    100,
+		BucketSize:  10,
+		Unreachable: 0.2,
+		GhostPeers:  0.2,
+		NonServers:  0.2,
+		Seed:        1,
+	})
+
+	if e.NumGhostsDiscovered == 0 || e.NumServers == e.NumReachable {
+		t.Fatalf("discovered %d ghost peers and %d non-servers, expected some of both", e.NumGhostsDiscovered, e.NumReachable-e.NumServers)
+	}
+	if e.NumDiscovered != e.NumDiscoverable {
+		t.Errorf("discovered %d peers, expected %d", e.NumDiscovered, e.NumDiscoverable)
+	}
+	if e.NumConnectable != e.NumReachable || e.NumCrawlable != e.NumServers {
+		t.Errorf("connected to %d and crawled %d peers, expected %d and %d", e.NumConnectable, e.NumCrawlable, e.NumReachable, e.NumServers)
+	}
+	if e.NumEdges == 0 || e.NumEdgesFound != e.NumEdges {
+		t.Errorf("found %d edges, expected %d", e.NumEdgesFound, e.NumEdges)
+	}
+	if e.NumFalsePositives != 0 || e.NumMisclassified != 0 {
+		t.Errorf("%d false positives and %d misclassified peers", e.NumFalsePositives, e.NumMisclassified)
+	}
+
+	stats := report.Stats()
+	if stats.NumNodes != e.NumDiscovered+e.NumGhostsDiscovered || stats.NumConnectable != e.NumConnectable || stats.NumCrawlable != e.NumCrawlable {
+		t.Errorf("stats report %d nodes, %d connectable and %d crawlable nodes, expected %d, %d and %d",
+			stats.NumNodes, stats.NumConnectable, stats.NumCrawlable, e.NumDiscovered+e.NumGhostsDiscovered, e.NumConnectable, e.NumCrawlable)
+	}
+	failed := 0
+	for _, status := range report.Nodes() {
+		if status.Connectable() {
+			continue
+		}
+		failed++
+		if code := crawlLib.ErrorCodeOf(status.ConnectionError); code != crawlLib.ErrorCodeDialTimeout {
+			t.Errorf("connection to %s failed with %s, expected %s", status.ID, code, crawlLib.ErrorCodeDialTimeout)
+		}
+	}
+	if failed != e.NumGhostsDiscovered {
+		t.Errorf("%d peers failed, expected %d", failed, e.NumGhostsDiscovered)
+	}
+}
+
+func TestWritePeergraphOfInterruptedCrawl(t *testing.T) {
+	// Few concurrent requests, so that most discovered peers are still
+	// queued when the crawl is interrupted.
+	cm, _ := newSimulatedCrawl(t, simulation.Config{NumPeers: 300, BucketSize: 10, Seed: 1}, func(c *crawlLib.CrawlManagerConfig) {
+		c.ConcurrentRequests = 2
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cm.AddObserver(&cancelAfter{n: 20, cancel: cancel})
+
+	report := cm.CrawlNetworkContext(ctx)
+	if !report.Partial() {
+		t.Fatal("interrupted crawl is not partial")
+	}
+
+	path := filepath.Join(t.TempDir(), "peerGraph.csv")
+	err := report.WritePeergraph(path)
+	if err != nil {
+		t.Fatalf("unable to write peer graph: %v", err)
+	}
+
+	writeOutputs(t, report)
+
+	// Neighbors which were never probed are not crawlable.
+	unprobed := 0
+	for _, row := range readPeergraph(t, path) {
+		target, err := peer.Decode(row[1])
+		if err != nil {
+			t.Fatalf("invalid target %q: %v", row[1], err)
+		}
+		if _, ok := report.Node(target); !ok {
+			unprobed++
+			if row[2] != "false" {
+				t.Errorf("unprobed peer %s is crawlable", target)
+			}
+		}
+	}
+	if unprobed == 0 {
+		t.Error("no edges to unprobed peers, the crawl was not interrupted early enough")
+	}
+}
+
+func TestWriteOutputOfCrawlEndedByDeadline(t *testing.T) {
+	cm, _ := newSimulatedCrawl(t, simulation.Config{NumPeers: 300, BucketSize: 10, Latency: 20 * time.Millisecond, Seed: 1}, func(c *crawlLib.CrawlManagerConfig) {
+		c.ConcurrentRequests = 2
+		c.MaxCrawlDuration = 300 * time.Millisecond
+	})
+
+	report := cm.CrawlNetwork()
+	if !report.Partial() {
+		t.Fatal("crawl ended by deadline is not partial")
+	}
+	if report.Stats().NumNodes >= 300 {
+		t.Fatal("all peers were probed, the deadline was too late")
+	}
+	writeOutputs(t, report)
+}
+
+func TestWriteOutputOfSimulatedCrawl(t *testing.T) {
+	simConfig := simulation.Config{NumPeers: 100, BucketSize: 10, Seed: 1}
+	cm, _ := newSimulatedCrawl(t, simConfig, nil)
+	report := cm.CrawlNetwork()
+	if report.Partial() {
+		t.Fatal("complete crawl is partial")
+	}
+	writeOutputs(t, report)
+
+	dir := t.TempDir()
+	peergraphPath := filepath.Join(dir, "peerGraph.csv")
+	err := report.WritePeergraph(peergraphPath)
+	if err != nil {
+		t.Fatalf("unable to write peer graph: %v", err)
+	}
+	written := readPeergraph(t, peergraphPath)
+
+	// The same network is crawled again, streaming the results.
+	cm, _ = newSimulatedCrawl(t, simConfig, nil)
+	streamedReport, streamed := streamOutputs(t, cm, cm.CrawlNetwork)
+	if streamedReport.Stats().NumNodes != report.Stats().NumNodes {
+		t.Errorf("streamed crawl found %d nodes, expected %d", streamedReport.Stats().NumNodes, report.Stats().NumNodes)
+	}
+	if len(written) == 0 || len(streamed) != len(written) {
+		t.Errorf("streamed peer graph has %d edges, expected %d", len(streamed), len(written))
+	}
+}
+
+func TestStreamOutputOfPartialSimulatedCrawl(t *testing.T) {
+	simConfig := simulation.Config{NumPeers: 300, BucketSize: 10, Latency: 20 * time.Millisecond, Seed: 1}
+
+	t.Run("interrupted", func(t *testing.T) {
+		cm, _ := newSimulatedCrawl(t, simConfig, func(c *crawlLib.CrawlManagerConfig) {
+			c.ConcurrentRequests = 2
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cm.AddObserver(&cancelAfter{n: 20, cancel: cancel})
+
+		report, _ := streamOutputs(t, cm, func() crawlLib.CrawlOutput { return cm.CrawlNetworkContext(ctx) })
+		if !report.Partial() {
+			t.Fatal("interrupted crawl is not partial")
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		cm, _ := newSimulatedCrawl(t, simConfig, func(c *crawlLib.CrawlManagerConfig) {
+			c.ConcurrentRequests = 2
+			c.MaxCrawlDuration = 300 * time.Millisecond
+		})
+
+		report, _ := streamOutputs(t, cm, cm.CrawlNetwork)
+		if !report.Partial() {
+			t.Fatal("crawl ended by deadline is not partial")
+		}
+		if report.Stats().NumNodes >= simConfig.NumPeers {
+			t.Fatal("all peers were probed, the deadline was too late")
+		}
+	})
+}
+
+func BenchmarkCrawlSimulatedNetwork(b *testing.B) {
+	simConfig := simulation.Config{NumPeers: 1000, BucketSize: 20, Seed: 1}
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		cm, _ := newSimulatedCrawl(b, simConfig, nil)
+		b.StartTimer()
+
+		report := cm.CrawlNetwork()
+		if report.Partial() {
+			b.Fatal("crawl is partial")
+		}
+	}
+}
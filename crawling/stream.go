@@ -0,0 +1,438 @@
+package crawling
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// streamedMetadataSuffix is appended to the metadata path to obtain the
+	// path of the NDJSON file written during the crawl.
+	streamedMetadataSuffix = ".ndjson"
+
+	// streamedPeergraphSuffix is appended to the peer graph path to obtain the
+	// path of the CSV file written during the crawl.
+	streamedPeergraphSuffix = ".partial"
+)
+
+// A StreamingWriter appends crawl results to disk as they arrive, instead of
+// keeping them in memory until the crawl is finished.
+//
+// Metadata is written as NDJSON, one node per line, in the same format as a
+// single entry of the found_nodes list of WriteMetadata.
+// The peer graph is written as CSV rows of the form
+// source,target,source_crawl_timestamp,bucket, since whether the target is
+// crawlable is only known at the end of the crawl.
+// Finalize converts both files to the formats written by WriteMetadata and
+// WritePeergraph. Since addresses may be learned after a node was written,
+// Finalize replaces the streamed addresses of each node with the addresses
+// known at the end of the crawl.
+//
+// Files are opened in append mode, so a crawl that is continued, e.g., from a
+// checkpoint, keeps writing to the same files.
+type StreamingWriter struct {
+	metadataPath  string
+	peergraphPath string
+
+	metadataFile  *os.File
+	metadata      *json.Encoder
+	peergraphFile *os.File
+	peergraph     *csv.Writer
+
+	// Whether the crawl was interrupted and when it was resumed.
+	partial   bool
+	resumedAt []time.Time
+
+	// The addresses known at the end of the crawl, by peer.
+	addrInfo map[peer.ID][]ma.Multiaddr
+
+	// Whether to leave the neighbors of partially crawled peers out of the
+	// peer graph.
+	excludePartial bool
+
+	// Whether to write the bucket column of the final peer graph.
+	// The streamed peer graph always includes it.
+	buckets bool
+}
+
+// NewStreamingWriter creates a new StreamingWriter whose final output will be
+// written to metadataPath and peergraphPath.
+// Intermediate results are written next to these files.
+func NewStreamingWriter(metadataPath string, peergraphPath string) (*StreamingWriter, error) {
+	mf, err := os.OpenFile(metadataPath+streamedMetadataSuffix, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o666)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open metadata stream: %w", err)
+	}
+	pf, err := os.OpenFile(peergraphPath+streamedPeergraphSuffix, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o666)
+	if err != nil {
+		_ = mf.Close()
+		return nil, fmt.Errorf("unable to open peer graph stream: %w", err)
+	}
+
+	return &StreamingWriter{
+		metadataPath:  metadataPath,
+		peergraphPath: peergraphPath,
+		metadataFile:  mf,
+		metadata:      json.NewEncoder(mf),
+		peergraphFile: pf,
+		peergraph:     csv.NewWriter(pf),
+	}, nil
+}
+
+// write appends the result of probing a single peer to the output files.
+// Only routing tables crawled so far are taken into account for whether the
+// peer appears in one.
+func (w *StreamingWriter) write(id peer.ID, status nodeCrawlStatus, addrs []ma.Multiaddr, dht dhtModeClassifier) error {
+	err := w.metadata.Encode(status.toCrawledNode(map[peer.ID][]ma.Multiaddr{id: addrs}, id, dht))
+	if err != nil {
+		return fmt.Errorf("unable to write metadata: %w", err)
+	}
+
+	if status.err != nil || status.result.crawlDataError != nil {
+		return nil
+	}
+	if w.excludePartial && status.result.crawlState() == CrawlStatePartial {
+		return nil
+	}
+	ts := status.result.crawlDataEndTs.Format(time.RFC3339)
+	buckets := status.result.neighborBuckets()
+	for _, neighbour := range status.result.crawlNeighbors {
+		err = w.peergraph.Write([]string{id.String(), neighbour.String(), ts, buckets[neighbour]})
+		if err != nil {
+			return fmt.Errorf("unable to write peer graph: %w", err)
+		}
+	}
+	w.peergraph.Flush()
+	if err = w.peergraph.Error(); err != nil {
+		return fmt.Errorf("unable to flush peer graph: %w", err)
+	}
+
+	return nil
+}
+
+// Close closes the intermediate files without converting them.
+func (w *StreamingWriter) Close() error {
+	w.peergraph.Flush()
+	err := w.peergraph.Error()
+	if err2 := w.peergraphFile.Close(); err == nil {
+		err = err2
+	}
+	if err2 := w.metadataFile.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Finalize closes the intermediate files and converts them to the formats
+// written by WriteMetadata and WritePeergraph.
+// If a peer was probed multiple times, only its last result is kept.
+// The intermediate files are removed afterwards.
+func (w *StreamingWriter) Finalize(startTs time.Time, endTs time.Time) error {
+	err := w.Close()
+	if err != nil {
+		return fmt.Errorf("unable to close intermediate files: %w", err)
+	}
+
+	header := crawlOutputHeaderJSON{StartDate: startTs, EndDate: endTs, Partial: w.partial, ResumedAt: w.resumedAt}
+	return finalizeStreamedOutput(header, w.metadataPath, w.peergraphPath, w.addrInfo, w.buckets)
+}
+
+// streamedNodeSummary is a helper struct to decode the parts of a streamed
+// node entry required for finalization.
+type streamedNodeSummary struct {
+	ID              peer.ID `json:"id"`
+	ConnectionError *string `json:"connection_error"`
+	Result          *struct {
+		CrawlEndTs time.Time `json:"crawl_end_ts"`
+		CrawlError *string   `json:"crawl_error"`
+	} `json:"result"`
+}
+
+// FinalizeStreamedOutput converts the intermediate files written by a
+// StreamingWriter for the given output paths to the formats written by
+// WriteMetadata and WritePeergraph.
+// This can be used to recover results after the crawler was terminated
+// unexpectedly, which is why the output is marked as partial.
+// Unlike with Finalize, nodes keep the addresses known when they were written.
+// withBucket decides whether the peer graph includes the bucket column, see
+// CrawlManagerConfig.PeergraphBuckets.
+func FinalizeStreamedOutput(startTs time.Time, endTs time.Time, metadataPath string, peergraphPath string, withBucket bool) error {
+	header := crawlOutputHeaderJSON{StartDate: startTs, EndDate: endTs, Partial: true}
+	return finalizeStreamedOutput(header, metadataPath, peergraphPath, nil, withBucket)
+}
+
+// finalizeStreamedOutput converts the intermediate files for the given output
+// paths.
+// The addresses of nodes found in addrInfo replace the streamed addresses.
+func finalizeStreamedOutput(header crawlOutputHeaderJSON, metadataPath string, peergraphPath string, addrInfo map[peer.ID][]ma.Multiaddr, withBucket bool) error {
+	streamedMetadataPath := metadataPath + streamedMetadataSuffix
+	streamedPeergraphPath := peergraphPath + streamedPeergraphSuffix
+
+	// First pass: find the last entry of each peer and whether it was
+	// crawlable.
+	lastEntry := make(map[peer.ID]int)
+	crawlTs := make(map[peer.ID]string)
+	err := forEachLine(streamedMetadataPath, func(i int, line []byte) error {
+		var node streamedNodeSummary
+		err := json.Unmarshal(line, &node)
+		if err != nil {
+			// This happens if the crawler was terminated while writing.
+			log.WithError(err).WithField("line", i+1).Warn("skipping malformed streamed metadata")
+			return nil
+		}
+		lastEntry[node.ID] = i
+		delete(crawlTs, node.ID)
+		if node.ConnectionError == nil && node.Result != nil && node.Result.CrawlError == nil {
+			crawlTs[node.ID] = node.Result.CrawlEndTs.Format(time.RFC3339)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to read streamed metadata: %w", err)
+	}
+
+	err = writeMetadataFromStream(header, metadataPath, streamedMetadataPath, lastEntry, addrInfo)
+	if err != nil {
+		return err
+	}
+	err = writePeergraphFromStream(peergraphPath, streamedPeergraphPath, crawlTs, withBucket)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(streamedMetadataPath); err != nil {
+		log.WithError(err).Warn("unable to remove streamed metadata")
+	}
+	if err = os.Remove(streamedPeergraphPath); err != nil {
+		log.WithError(err).Warn("unable to remove streamed peer graph")
+	}
+
+	return nil
+}
+
+func writeMetadataFromStream(header crawlOutputHeaderJSON, path string, streamedPath string, lastEntry map[peer.ID]int, addrInfo map[peer.ID][]ma.Multiaddr) error {
+	vf, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("unable to open output file: %w", err)
+	}
+	defer func() { _ = vf.Close() }()
+	out := bufio.NewWriter(vf)
+
+	// This mirrors the encoding of crawlOutputJSON.
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return fmt.Errorf("unable to encode header: %w", err)
+	}
+	_, _ = out.Write(headerBytes[:len(headerBytes)-1])
+	_, _ = out.WriteString(`,"found_nodes":`)
+
+	first := true
+	err = forEachLine(streamedPath, func(i int, line []byte) error {
+		var node streamedNodeSummary
+		err := json.Unmarshal(line, &node)
+		if err != nil {
+			// Already reported in the first pass.
+			return nil
+		}
+		if last, ok := lastEntry[node.ID]; !ok || last != i {
+			// Superseded by a later attempt.
+			return nil
+		}
+		if addrs, ok := addrInfo[node.ID]; ok {
+			replaced, err := replaceStreamedAddrs(line, addrs)
+			if err != nil {
+				log.WithError(err).WithField("peer", node.ID).Warn("unable to replace streamed addresses, keeping them")
+			} else {
+				line = replaced
+			}
+		}
+		if first {
+			_, _ = out.WriteString("[")
+			first = false
+		} else {
+			_, _ = out.WriteString(",")
+		}
+		_, err = out.Write(line)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write output: %w", err)
+	}
+	if first {
+		_, _ = out.WriteString("null")
+	} else {
+		_, _ = out.WriteString("]")
+	}
+	_, _ = out.WriteString("}\n")
+
+	err = out.Flush()
+	if err != nil {
+		return fmt.Errorf("unable to write output: %w", err)
+	}
+	return vf.Close()
+}
+
+func writePeergraphFromStream(path string, streamedPath string, crawlTs map[peer.ID]string, withBucket bool) error {
+	in, err := os.Open(streamedPath)
+	if err != nil {
+		return fmt.Errorf("unable to open streamed peer graph: %w", err)
+	}
+	defer func() { _ = in.Close() }()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("unable to open output file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	r := csv.NewReader(bufio.NewReader(in))
+	r.FieldsPerRecord = -1
+	w := csv.NewWriter(f)
+
+	err = w.Write(peergraphRow(withBucket, "source", "target", "target_crawlable", "source_crawl_timestamp", "bucket"))
+	if err != nil {
+		return fmt.Errorf("unable to write output: %w", err)
+	}
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read streamed peer graph: %w", err)
+		}
+		if len(row) == 3 {
+			// Written before buckets were recorded.
+			row = append(row, "")
+		}
+		if len(row) != 4 {
+			// This happens if the crawler was terminated while writing.
+			log.WithField("row", row).Warn("skipping malformed streamed peer graph row")
+			continue
+		}
+
+		source, err := peer.Decode(row[0])
+		if err != nil {
+			log.WithError(err).WithField("row", row).Warn("skipping malformed streamed peer graph row")
+			continue
+		}
+		target, err := peer.Decode(row[1])
+		if err != nil {
+			log.WithError(err).WithField("row", row).Warn("skipping malformed streamed peer graph row")
+			continue
+		}
+
+		// Skip rows of crawls which have been superseded by a later attempt.
+		if ts, ok := crawlTs[source]; !ok || ts != row[2] {
+			continue
+		}
+		_, crawlable := crawlTs[target]
+
+		err = w.Write(peergraphRow(withBucket, row[0], row[1], fmt.Sprintf("%t", crawlable), row[2], row[3]))
+		if err != nil {
+			return fmt.Errorf("unable to write output: %w", err)
+		}
+	}
+
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return fmt.Errorf("unable to flush CSV writer: %w", err)
+	}
+
+	return f.Close()
+}
+
+// replaceStreamedAddrs replaces the multiaddrs of a streamed node entry with
+// the given addresses.
+// The entry is spliced rather than decoded and encoded again, to keep it
+// exactly as written otherwise. This relies on multiaddrs directly following
+// the ID, as in crawledNodeJSON.
+func replaceStreamedAddrs(line []byte, addrs []ma.Multiaddr) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	err := expectToken(dec, json.Delim('{'))
+	if err != nil {
+		return nil, err
+	}
+	err = expectToken(dec, "id")
+	if err != nil {
+		return nil, err
+	}
+	var id json.RawMessage
+	err = dec.Decode(&id)
+	if err != nil {
+		return nil, err
+	}
+	err = expectToken(dec, "multiaddrs")
+	if err != nil {
+		return nil, err
+	}
+	begin := dec.InputOffset()
+	var old json.RawMessage
+	err = dec.Decode(&old)
+	if err != nil {
+		return nil, err
+	}
+	end := dec.InputOffset()
+
+	encoded, err := json.Marshal(addrs)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]byte, 0, len(line)-int(end-begin)+len(encoded)+1)
+	res = append(res, line[:begin]...)
+	res = append(res, ':')
+	res = append(res, encoded...)
+	return append(res, line[end:]...), nil
+}
+
+// expectToken reads the next token from the given decoder and fails if it is
+// not the given one.
+func expectToken(dec *json.Decoder, want json.Token) error {
+	got, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("unexpected token %v, expected %v", got, want)
+	}
+	return nil
+}
+
+// forEachLine calls fn for each non-empty line of the file at path.
+func forEachLine(path string, fn func(i int, line []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	r := bufio.NewReader(f)
+	for i := 0; ; {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			line = line[:len(line)-1]
+		}
+		if len(line) > 0 {
+			if fnErr := fn(i, line); fnErr != nil {
+				return fnErr
+			}
+			i++
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package crawling
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Timings break down the time spent probing a peer by phase.
+// Phases which were not reached or whose duration is unknown, e.g., for
+// results restored from older checkpoints, are zero.
+// The FIND_NODE requests are timed per bucket, see BucketResult.
+type Timings struct {
+	// Connecting to the peer, over all attempts. This includes waiting for
+	// libp2p's own identify exchange.
+	Connect PhaseTiming
+
+	// For the successful connection attempt, the time until the connection
+	// was secured, and the time it then took to negotiate a stream
+	// multiplexer.
+	// The former includes the delays libp2p applies when dialing multiple
+	// addresses, establishing the transport connection and the security
+	// handshake, which libp2p does not time separately. The latter is zero
+	// for transports with built-in multiplexing, such as QUIC.
+	Dial  time.Duration
+	Muxer time.Duration
+
+	// Identifying the peer, over all attempts.
+	Identify PhaseTiming
+
+	// Opening the first DHT stream, including protocol negotiation, over all
+	// attempts.
+	Stream PhaseTiming
+}
+
+// PhaseTiming is the time spent in a phase of probing a peer, and the number of
+// attempts it took.
+type PhaseTiming struct {
+	Duration time.Duration
+	Attempts uint
+}
+
+// handshakeTimer is a connection gater which allows all connections, but
+// records when outbound connections to watched peers were secured and
+// upgraded.
+type handshakeTimer struct {
+	m       sync.Mutex
+	watched map[peer.ID]*handshakeTimes
+}
+
+// handshakeTimes holds the times recorded for a watched peer.
+type handshakeTimes struct {
+	// When the connections to the peer were secured, by remote address.
+	secured map[string]time.Time
+
+	// Set once the first connection was upgraded.
+	upgraded   bool
+	securedTs  time.Time
+	upgradedTs time.Time
+}
+
+func newHandshakeTimer() *handshakeTimer {
+	return &handshakeTimer{watched: make(map[peer.ID]*handshakeTimes)}
+}
+
+// watch starts recording the handshakes with the given peer, discarding what
+// was recorded before.
+func (t *handshakeTimer) watch(p peer.ID) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.watched[p] = &handshakeTimes{secured: make(map[string]time.Time)}
+}
+
+// unwatch stops recording the handshakes with the given peer and returns when
+// the first connection to it was secured and upgraded, if it was.
+func (t *handshakeTimer) unwatch(p peer.ID) (securedTs time.Time, upgradedTs time.Time, ok bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	times := t.watched[p]
+	delete(t.watched, p)
+	if times == nil || !times.upgraded || times.securedTs.IsZero() {
+		return time.Time{}, time.Time{}, false
+	}
+	return times.securedTs, times.upgradedTs, true
+}
+
+// InterceptPeerDial implements connmgr.ConnectionGater.
+func (*handshakeTimer) InterceptPeerDial(peer.ID) bool {
+	return true
+}
+
+// InterceptAddrDial implements connmgr.ConnectionGater.
+func (*handshakeTimer) InterceptAddrDial(peer.ID, ma.Multiaddr) bool {
+	return true
+}
+
+// InterceptAccept implements connmgr.ConnectionGater.
+func (*handshakeTimer) InterceptAccept(network.ConnMultiaddrs) bool {
+	return true
+}
+
+// InterceptSecured implements connmgr.ConnectionGater.
+func (t *handshakeTimer) InterceptSecured(dir network.Direction, p peer.ID, c network.ConnMultiaddrs) bool {
+	if dir != network.DirOutbound {
+		return true
+	}
+	now := time.Now()
+	t.m.Lock()
+	defer t.m.Unlock()
+	if times, ok := t.watched[p]; ok {
+		times.secured[string(c.RemoteMultiaddr().Bytes())] = now
+	}
+	return true
+}
+
+// InterceptUpgraded implements connmgr.ConnectionGater.
+func (t *handshakeTimer) InterceptUpgraded(c network.Conn) (bool, control.DisconnectReason) {
+	if c.Stat().Direction != network.DirOutbound {
+		return true, 0
+	}
+	now := time.Now()
+	t.m.Lock()
+	defer t.m.Unlock()
+	if times, ok := t.watched[c.RemotePeer()]; ok && !times.upgraded {
+		times.upgraded = true
+		times.upgradedTs = now
+		times.securedTs = times.secured[string(c.RemoteMultiaddr().Bytes())]
+	}
+	return true, 0
+}
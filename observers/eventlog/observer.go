@@ -0,0 +1,222 @@
+// Package eventlog implements an observer which writes crawl events to a file
+// as they happen, one JSON object per line.
+package eventlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"gopkg.in/yaml.v3"
+
+	crawlLib "ipfs-crawler/crawling"
+)
+
+const observerName = "event-log"
+
+// Event types, as used in the "event" field of the output.
+const (
+	EventPeerDiscovered = "peer_discovered"
+	EventCrawlStarted   = "crawl_started"
+	EventCrawlFinished  = "crawl_finished"
+	EventCrawlComplete  = "crawl_complete"
+)
+
+// Config contains the configuration for the observer.
+type Config struct {
+	// Path to the file to write events to.
+	// Events are appended if the file exists.
+	FilePath string `yaml:"file_path"`
+}
+
+func init() {
+	crawlLib.RegisterObserver(observerName, driver{})
+}
+
+type driver struct{}
+
+func (driver) NewObserver(cfgBytes []byte) (crawlLib.Observer, error) {
+	var cfg Config
+	err := yaml.Unmarshal(cfgBytes, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode config: %w", err)
+	}
+	if len(cfg.FilePath) == 0 {
+		return nil, fmt.Errorf("missing file_path")
+	}
+
+	f, err := os.OpenFile(cfg.FilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open event log: %w", err)
+	}
+
+	return &eventLog{
+		f:   f,
+		enc: json.NewEncoder(f),
+	}, nil
+}
+
+// event is a single line of the event log.
+// Which fields are set depends on the type of event.
+type event struct {
+	Event     string    `json:"event"`
+	Timestamp time.Time `json:"timestamp"`
+
+	Peer   peer.ID        `json:"peer,omitempty"`
+	Addrs  []ma.Multiaddr `json:"addrs,omitempty"`
+	Source peer.ID        `json:"source,omitempty"`
+
+	// Set for EventCrawlFinished.
+	Worker       string              `json:"worker,omitempty"`
+	Connectable  *bool               `json:"connectable,omitempty"`
+	Crawlable    *bool               `json:"crawlable,omitempty"`
+	CrawlState   crawlLib.CrawlState `json:"crawl_state,omitempty"`
+	DHTMode      crawlLib.DHTMode    `json:"dht_mode,omitempty"`
+	Error        *string             `json:"error,omitempty"`
+	ErrorCode    crawlLib.ErrorCode  `json:"error_code,omitempty"`
+	AgentVersion string              `json:"agent_version,omitempty"`
+	Neighbors    []peer.ID           `json:"neighbors,omitempty"`
+
+	// Set for EventCrawlComplete.
+	Stats *stats `json:"stats,omitempty"`
+}
+
+// stats is a helper struct to serialize a crawlLib.CrawlStats.
+type stats struct {
+	NumDiscovered  int `json:"num_discovered"`
+	NumNodes       int `json:"num_nodes"`
+	NumConnectable int `json:"num_connectable"`
+	NumCrawlable   int `json:"num_crawlable"`
+	NumPartial     int `json:"num_partial"`
+	NumAbandoned   int `json:"num_abandoned"`
+
+	NumDHTServers                int `json:"num_dht_servers"`
+	NumDHTClients                int `json:"num_dht_clients"`
+	NumDHTClientsInRoutingTables int `json:"num_dht_clients_in_routing_tables"`
+
+	NumAddrsCompared   int `json:"num_addrs_compared"`
+	NumAddrsIdentical  int `json:"num_addrs_identical"`
+	NumAddrsDisjoint   int `json:"num_addrs_disjoint"`
+	NumCommonAddrs     int `json:"num_common_addrs"`
+	NumDHTOnlyAddrs    int `json:"num_dht_only_addrs"`
+	NumListenOnlyAddrs int `json:"num_listen_only_addrs"`
+
+	NumRTTsByPing     int `json:"num_rtts_by_ping"`
+	NumRTTsByFindNode int `json:"num_rtts_by_find_node"`
+
+	Transports map[crawlLib.Transport]transportStats `json:"transports,omitempty"`
+}
+
+// transportStats is a helper struct to serialize a crawlLib.TransportStats.
+type transportStats struct {
+	NumPeers     int `json:"num_peers"`
+	NumReachable int `json:"num_reachable"`
+}
+
+type eventLog struct {
+	m   sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func (l *eventLog) write(e event) {
+	e.Timestamp = time.Now()
+
+	l.m.Lock()
+	defer l.m.Unlock()
+	// Errors are not fatal to the crawl, and we have nowhere to report them.
+	_ = l.enc.Encode(e)
+}
+
+func (l *eventLog) OnPeerDiscovered(p peer.AddrInfo, source peer.ID) {
+	l.write(event{
+		Event:  EventPeerDiscovered,
+		Peer:   p.ID,
+		Addrs:  p.Addrs,
+		Source: source,
+	})
+}
+
+func (l *eventLog) OnCrawlStarted(p peer.AddrInfo) {
+	l.write(event{
+		Event: EventCrawlStarted,
+		Peer:  p.ID,
+		Addrs: p.Addrs,
+	})
+}
+
+func (l *eventLog) OnCrawlFinished(result crawlLib.NodeStatus) {
+	connectable := result.Connectable()
+	crawlable := result.Crawlable()
+	e := event{
+		Event:       EventCrawlFinished,
+		Peer:        result.ID,
+		Worker:      result.Worker,
+		Connectable: &connectable,
+		Crawlable:   &crawlable,
+		DHTMode:     result.DHTMode,
+	}
+	if result.ConnectionError != nil {
+		tmp := result.ConnectionError.Error()
+		e.Error = &tmp
+		e.ErrorCode = crawlLib.ErrorCodeOf(result.ConnectionError)
+	}
+	if result.Info != nil {
+		e.AgentVersion = result.Info.Metadata.AgentVersion
+		e.Neighbors = result.Info.Neighbors
+		e.CrawlState = result.Info.CrawlState()
+		if result.Info.CrawlError != nil {
+			tmp := result.Info.CrawlError.Error()
+			e.Error = &tmp
+			e.ErrorCode = crawlLib.ErrorCodeOf(result.Info.CrawlError)
+		}
+	}
+	l.write(e)
+}
+
+func (l *eventLog) OnCrawlComplete(summary crawlLib.CrawlStats) {
+	var transports map[crawlLib.Transport]transportStats
+	if len(summary.Transports) != 0 {
+		transports = make(map[crawlLib.Transport]transportStats)
+		for t, ts := range summary.Transports {
+			transports[t] = transportStats{NumPeers: ts.NumPeers, NumReachable: ts.NumReachable}
+		}
+	}
+	l.write(event{
+		Event: EventCrawlComplete,
+		Stats: &stats{
+			NumDiscovered:  summary.NumDiscovered,
+			NumNodes:       summary.NumNodes,
+			NumConnectable: summary.NumConnectable,
+			NumCrawlable:   summary.NumCrawlable,
+			NumPartial:     summary.NumPartial,
+			NumAbandoned:   summary.NumAbandoned,
+
+			NumDHTServers:                summary.NumDHTServers,
+			NumDHTClients:                summary.NumDHTClients,
+			NumDHTClientsInRoutingTables: summary.NumDHTClientsInRoutingTables,
+
+			NumAddrsCompared:   summary.NumAddrsCompared,
+			NumAddrsIdentical:  summary.NumAddrsIdentical,
+			NumAddrsDisjoint:   summary.NumAddrsDisjoint,
+			NumCommonAddrs:     summary.NumCommonAddrs,
+			NumDHTOnlyAddrs:    summary.NumDHTOnlyAddrs,
+			NumListenOnlyAddrs: summary.NumListenOnlyAddrs,
+
+			NumRTTsByPing:     summary.NumRTTsByPing,
+			NumRTTsByFindNode: summary.NumRTTsByFindNode,
+
+			Transports: transports,
+		},
+	})
+}
+
+func (l *eventLog) Shutdown() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.f.Close()
+}
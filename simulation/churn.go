@@ -0,0 +1,61 @@
+package simulation
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sessions describes when a peer is online, as alternating online and
+// offline periods with exponentially distributed durations.
+// Periods are generated lazily, but deterministically from the seed.
+type sessions struct {
+	m sync.Mutex
+
+	rng         *rand.Rand
+	meanOnline  time.Duration
+	meanOffline time.Duration
+
+	initiallyOnline bool
+
+	// The offsets from the start of the simulation at which the peer goes
+	// online or offline, in ascending order.
+	toggles []time.Duration
+}
+
+// newSessions creates the sessions of a peer. Whether the peer is initially
+// online is drawn according to the fraction of time peers are online.
+func newSessions(seed int64, meanOnline, meanOffline time.Duration) *sessions {
+	rng := rand.New(rand.NewSource(seed))
+	return &sessions{
+		rng:             rng,
+		meanOnline:      meanOnline,
+		meanOffline:     meanOffline,
+		initiallyOnline: rng.Float64() < float64(meanOnline)/float64(meanOnline+meanOffline),
+	}
+}
+
+// online returns whether the peer is online at the given offset from the start
+// of the simulation.
+func (s *sessions) online(offset time.Duration) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for len(s.toggles) == 0 || s.toggles[len(s.toggles)-1] <= offset {
+		var last time.Duration
+		if len(s.toggles) != 0 {
+			last = s.toggles[len(s.toggles)-1]
+		}
+		mean := s.meanOffline
+		if s.initiallyOnline == (len(s.toggles)%2 == 0) {
+			mean = s.meanOnline
+		}
+		// Make sure we advance, even for tiny durations.
+		s.toggles = append(s.toggles, last+time.Duration(s.rng.ExpFloat64()*float64(mean))+1)
+	}
+
+	// The number of state changes up to and including offset.
+	changes := sort.Search(len(s.toggles), func(i int) bool { return s.toggles[i] > offset })
+	return s.initiallyOnline == (changes%2 == 0)
+}
@@ -0,0 +1,121 @@
+package simulation
+
+import (
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	crawlLib "ipfs-crawler/crawling"
+)
+
+// Evaluation compares the output of a crawl of a simulated network with the
+// ground truth.
+// Churn is not taken into account, i.e., peers count as reachable if they are
+// reachable while they are online.
+type Evaluation struct {
+	// The number of peers in the network, excluding peers that left it.
+	NumPeers int
+
+	// The number of peers in the routing table of at least one peer, which
+	// could be discovered by a crawl, and how many of them were.
+	NumDiscoverable int
+	NumDiscovered   int
+
+	// The number of peers which have left the network and were discovered
+	// through stale routing table entries.
+	NumGhostsDiscovered int
+
+	// The number of reachable peers, and how many of them were connected to.
+	NumReachable   int
+	NumConnectable int
+
+	// The number of reachable peers that serve the DHT, and how many of them
+	// were crawled.
+	NumServers   int
+	NumCrawlable int
+
+	// The number of routing table entries of crawled peers, and how many of
+	// them were found.
+	NumEdges      int
+	NumEdgesFound int
+
+	// The number of peers that were reported as connectable or crawlable,
+	// although they are not. This should be zero.
+	NumFalsePositives int
+
+	// The number of peers we connected to whose DHT mode was classified
+	// wrongly, i.e., not as client if they do not serve the DHT or not as
+	// server if they do. This should be zero.
+	NumMisclassified int
+}
+
+// Evaluate compares the output of a crawl of the network with the ground
+// truth.
+// Edges are only counted if the output holds the peer graph, i.e., the results
+// were not streamed.
+func (n *Network) Evaluate(report *crawlLib.CrawlOutput) Evaluation {
+	var e Evaluation
+
+	discoverable := make(map[peer.ID]struct{})
+	for _, id := range n.order {
+		p := n.peers[id]
+		if p.ghost {
+			continue
+		}
+		e.NumPeers++
+		if !p.unreachable {
+			e.NumReachable++
+			if !p.nonServer {
+				e.NumServers++
+			}
+		}
+		for _, other := range p.routingTable {
+			if !n.peers[other].ghost {
+				discoverable[other] = struct{}{}
+			}
+		}
+	}
+	e.NumDiscoverable = len(discoverable)
+
+	for id, status := range report.Nodes() {
+		p, ok := n.peers[id]
+		if !ok {
+			continue
+		}
+		if p.ghost {
+			e.NumGhostsDiscovered++
+		} else {
+			e.NumDiscovered++
+		}
+		if status.Info == nil {
+			continue
+		}
+		if p.ghost || p.unreachable {
+			e.NumFalsePositives++
+			continue
+		}
+		e.NumConnectable++
+		if (p.nonServer && status.DHTMode != crawlLib.DHTModeClient) || (!p.nonServer && status.DHTMode != crawlLib.DHTModeServer) {
+			e.NumMisclassified++
+		}
+		if status.Info.CrawlError != nil {
+			continue
+		}
+		if p.nonServer {
+			e.NumFalsePositives++
+			continue
+		}
+		e.NumCrawlable++
+
+		inTable := make(map[peer.ID]struct{}, len(p.routingTable))
+		for _, other := range p.routingTable {
+			inTable[other] = struct{}{}
+		}
+		e.NumEdges += len(p.routingTable)
+		for _, neighbor := range report.Neighbors(id) {
+			if _, ok := inTable[neighbor]; ok {
+				e.NumEdgesFound++
+			}
+		}
+	}
+
+	return e
+}
@@ -0,0 +1,359 @@
+// Package simulation implements a synthetic Kademlia network with known
+// properties, which can be crawled via crawling.NewCrawlManagerWithNetwork to
+// test and benchmark the crawler offline.
+//
+// The network consists of peers with routing tables built from each other,
+// some of which are unreachable, do not serve the DHT, churn, or have left the
+// network while remaining in routing tables. Requests are answered after a
+// configurable latency and fail at a configurable rate.
+// Failures are reported right away, without waiting for timeouts to expire, to
+// keep simulations fast.
+package simulation
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+	msmux "github.com/multiformats/go-multistream"
+
+	crawlLib "ipfs-crawler/crawling"
+)
+
+// Protocol is the DHT protocol announced by peers which serve the DHT.
+const Protocol protocol.ID = "/ipfs/kad/1.0.0"
+
+// AgentVersion is the agent version announced by all peers.
+const AgentVersion = "simulated-peer"
+
+// ProtocolVersion is the protocol version announced by all peers.
+const ProtocolVersion = "ipfs/0.1.0"
+
+// Config configures a simulated network.
+// Fractions and probabilities are given as numbers between 0 and 1.
+type Config struct {
+	// The number of peers in the network.
+	NumPeers int `yaml:"num_peers"`
+
+	// The maximum number of peers per bucket of a routing table, which is
+	// also the maximum number of peers in a FIND_NODE response.
+	// Defaults to 20.
+	BucketSize int `yaml:"bucket_size"`
+
+	// The probability that a peer does not know another peer, even though
+	// the respective bucket has room for it.
+	MissingEntries float64 `yaml:"missing_entries"`
+
+	// The number of peers which have left the network, but still appear in
+	// routing tables, relative to NumPeers.
+	GhostPeers float64 `yaml:"ghost_peers"`
+
+	// The fraction of peers that refuse connections, e.g., because they are
+	// behind a NAT.
+	Unreachable float64 `yaml:"unreachable"`
+
+	// The fraction of reachable peers that do not serve the DHT.
+	NonServers float64 `yaml:"non_servers"`
+
+	// The probability that a single FIND_NODE request fails.
+	FindNodeFailures float64 `yaml:"find_node_failures"`
+
+	// The mean latency of connecting and of FIND_NODE requests.
+	Latency time.Duration `yaml:"latency"`
+
+	// The maximum deviation from the mean latency, in either direction.
+	LatencyJitter time.Duration `yaml:"latency_jitter"`
+
+	// The mean duration of the sessions in which a peer is online and of
+	// the periods in which it is offline, both exponentially distributed.
+	// If MeanOffline is zero, peers are always online.
+	MeanOnline  time.Duration `yaml:"mean_online"`
+	MeanOffline time.Duration `yaml:"mean_offline"`
+
+	// The seed for all randomness. Networks with the same configuration and
+	// seed have the same peers, routing tables and churn.
+	Seed int64 `yaml:"seed"`
+}
+
+func (c *Config) check() error {
+	if c.NumPeers <= 0 {
+		return fmt.Errorf("missing or invalid num_peers")
+	}
+	if c.BucketSize < 0 {
+		return fmt.Errorf("invalid bucket_size")
+	}
+	for name, v := range map[string]float64{
+		"missing_entries":    c.MissingEntries,
+		"unreachable":        c.Unreachable,
+		"non_servers":        c.NonServers,
+		"find_node_failures": c.FindNodeFailures,
+	} {
+		if v < 0 || v > 1 {
+			return fmt.Errorf("invalid %s", name)
+		}
+	}
+	if c.GhostPeers < 0 {
+		return fmt.Errorf("invalid ghost_peers")
+	}
+	if c.Latency < 0 || c.LatencyJitter < 0 || c.LatencyJitter > c.Latency {
+		return fmt.Errorf("invalid latency or latency_jitter")
+	}
+	if c.MeanOffline < 0 || (c.MeanOffline > 0 && c.MeanOnline <= 0) {
+		return fmt.Errorf("invalid mean_online or mean_offline")
+	}
+	return nil
+}
+
+// simPeer is a peer of a simulated network.
+type simPeer struct {
+	info peer.AddrInfo
+	key  kb.ID
+
+	// Whether the peer has left the network, but remains in routing tables.
+	ghost bool
+
+	unreachable bool
+	nonServer   bool
+
+	routingTable []peer.ID
+	sessions     *sessions
+}
+
+// A Network is a simulated Kademlia network.
+// It implements crawling.Network.
+type Network struct {
+	config Config
+	start  time.Time
+
+	peers map[peer.ID]*simPeer
+
+	// All peers, including ghosts, in order of creation.
+	order []peer.ID
+
+	m   sync.Mutex
+	rng *rand.Rand
+}
+
+var _ crawlLib.Network = (*Network)(nil)
+
+// New creates a simulated network.
+// Churn is simulated relative to the time New is called.
+func New(config Config) (*Network, error) {
+	err := config.check()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if config.BucketSize == 0 {
+		config.BucketSize = 20
+	}
+
+	rng := rand.New(rand.NewSource(config.Seed))
+	n := &Network{
+		config: config,
+		start:  time.Now(),
+		peers:  make(map[peer.ID]*simPeer),
+		rng:    rand.New(rand.NewSource(rng.Int63())),
+	}
+
+	numGhosts := int(math.Round(config.GhostPeers * float64(config.NumPeers)))
+	for i := 0; i < config.NumPeers+numGhosts; i++ {
+		p, err := newSimPeer(rng, i)
+		if err != nil {
+			return nil, err
+		}
+		if i >= config.NumPeers {
+			p.ghost = true
+		} else if rng.Float64() < config.Unreachable {
+			p.unreachable = true
+		} else if rng.Float64() < config.NonServers {
+			p.nonServer = true
+		}
+		if config.MeanOffline > 0 {
+			p.sessions = newSessions(rng.Int63(), config.MeanOnline, config.MeanOffline)
+		}
+		n.peers[p.info.ID] = p
+		n.order = append(n.order, p.info.ID)
+	}
+
+	for _, id := range n.order[:config.NumPeers] {
+		n.buildRoutingTable(rng, n.peers[id])
+	}
+
+	return n, nil
+}
+
+// newSimPeer creates the i-th peer of a network, with a fresh identity and a
+// unique public IPv4 address.
+func newSimPeer(rng *rand.Rand, i int) (*simPeer, error) {
+	_, pub, err := crypto.GenerateEd25519Key(rng)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate key: %w", err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("unable to derive peer ID: %w", err)
+	}
+	addr, err := ma.NewMultiaddr(fmt.Sprintf("/ip4/11.%d.%d.%d/tcp/4001", (i>>16)&0xff, (i>>8)&0xff, i&0xff))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create address: %w", err)
+	}
+	return &simPeer{
+		info: peer.AddrInfo{ID: id, Addrs: []ma.Multiaddr{addr}},
+		key:  kb.ConvertPeerID(id),
+	}, nil
+}
+
+// buildRoutingTable fills the buckets of the given peer with other peers, in
+// random order, skipping MissingEntries of them.
+func (n *Network) buildRoutingTable(rng *rand.Rand, p *simPeer) {
+	buckets := make(map[int]int)
+	for _, i := range rng.Perm(len(n.order)) {
+		other := n.peers[n.order[i]]
+		if other == p || (other.unreachable && !other.ghost) {
+			// Unreachable peers are only added to routing tables once
+			// they are known to be reachable, i.e., never.
+			continue
+		}
+		cpl := kb.CommonPrefixLen(p.key, other.key)
+		if buckets[cpl] >= n.config.BucketSize || rng.Float64() < n.config.MissingEntries {
+			continue
+		}
+		buckets[cpl]++
+		p.routingTable = append(p.routingTable, other.info.ID)
+	}
+}
+
+// BootstrapPeers returns the addresses of up to num peers that serve the DHT
+// and are online at the time of the call, in the format of
+// crawling.CrawlManagerConfig.BootstrapPeers.
+func (n *Network) BootstrapPeers(num int) []string {
+	var res []string
+	now := time.Now()
+	for _, id := range n.order {
+		if len(res) == num {
+			break
+		}
+		p := n.peers[id]
+		if p.ghost || p.unreachable || p.nonServer || !n.online(p, now) {
+			continue
+		}
+		res = append(res, fmt.Sprintf("%s/p2p/%s", p.info.Addrs[0], id))
+	}
+	return res
+}
+
+// online returns whether the given peer is online at the given time.
+func (n *Network) online(p *simPeer, t time.Time) bool {
+	if p.ghost {
+		return false
+	}
+	if p.sessions == nil {
+		return true
+	}
+	return p.sessions.online(t.Sub(n.start))
+}
+
+// delay waits for a random latency, or until the context is done.
+func (n *Network) delay(ctx context.Context) error {
+	if n.config.Latency == 0 {
+		return ctx.Err()
+	}
+	latency := n.config.Latency
+	if n.config.LatencyJitter > 0 {
+		n.m.Lock()
+		latency += time.Duration(n.rng.Int63n(int64(2*n.config.LatencyJitter)+1)) - n.config.LatencyJitter
+		n.m.Unlock()
+	}
+	t := time.NewTimer(latency)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// chance returns true with the given probability.
+func (n *Network) chance(probability float64) bool {
+	if probability == 0 {
+		return false
+	}
+	n.m.Lock()
+	defer n.m.Unlock()
+	return n.rng.Float64() < probability
+}
+
+// Connect implements crawling.Network.
+// Connections to peers that are offline or have left the network time out,
+// connections to unreachable peers are refused.
+func (n *Network) Connect(ctx context.Context, p peer.AddrInfo) (crawlLib.PeerMetadata, ma.Multiaddr, error) {
+	sp, ok := n.peers[p.ID]
+	if !ok || !n.online(sp, time.Now()) {
+		return crawlLib.PeerMetadata{}, nil, fmt.Errorf("simulated peer offline: %w", os.ErrDeadlineExceeded)
+	}
+	if sp.unreachable {
+		return crawlLib.PeerMetadata{}, nil, fmt.Errorf("simulated peer unreachable: %w", syscall.ECONNREFUSED)
+	}
+	err := n.delay(ctx)
+	if err != nil {
+		return crawlLib.PeerMetadata{}, nil, err
+	}
+
+	md := crawlLib.PeerMetadata{
+		AgentVersion:    AgentVersion,
+		ProtocolVersion: ProtocolVersion,
+		ListenAddrs:     sp.info.Addrs,
+		PublicKeyType:   "Ed25519",
+	}
+	if !sp.nonServer {
+		md.SupportedProtocols = []protocol.ID{Protocol}
+	}
+	return md, sp.info.Addrs[0], nil
+}
+
+// FindNode implements crawling.Network.
+// The response contains the peers in the peer's routing table that are
+// closest to a key that has a common prefix of length cpl with the peer's key,
+// as an ideal preimage would.
+func (n *Network) FindNode(ctx context.Context, p peer.ID, cpl uint8) ([]peer.AddrInfo, error) {
+	sp, ok := n.peers[p]
+	if !ok {
+		return nil, fmt.Errorf("unknown simulated peer %s", p)
+	}
+	if sp.nonServer {
+		return nil, msmux.ErrNotSupported[protocol.ID]{Protos: []protocol.ID{Protocol}}
+	}
+	err := n.delay(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !n.online(sp, time.Now()) || n.chance(n.config.FindNodeFailures) {
+		return nil, fmt.Errorf("simulated failure: %w", network.ErrReset)
+	}
+
+	target := make(kb.ID, len(sp.key))
+	copy(target, sp.key)
+	target[cpl/8] ^= 0x80 >> (cpl % 8)
+
+	closest := kb.SortClosestPeers(sp.routingTable, target)
+	if len(closest) > n.config.BucketSize {
+		closest = closest[:n.config.BucketSize]
+	}
+	res := make([]peer.AddrInfo, 0, len(closest))
+	for _, id := range closest {
+		res = append(res, n.peers[id].info)
+	}
+	return res, nil
+}